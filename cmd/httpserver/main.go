@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -10,20 +12,50 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/isparth/httpfromtcp/internal/accesslog"
+	"github.com/isparth/httpfromtcp/internal/compress"
+	"github.com/isparth/httpfromtcp/internal/http2"
+	"github.com/isparth/httpfromtcp/internal/metrics"
 	"github.com/isparth/httpfromtcp/internal/request"
 	"github.com/isparth/httpfromtcp/internal/response"
 	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/isparth/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
 
 func main() {
+	stats := metrics.New(metrics.Options{})
+
 	// 1. Define our handler logic
 	handler := func(w *response.Writer, req *request.Request) {
 		target := req.RequestLine.RequestTarget
 
-		fmt.Println(target)
+		if target == "/metrics" {
+			stats.Handler(w, req)
+			return
+		}
+
+		if target == "/ws" {
+			conn, err := websocket.Upgrade(w, req, websocket.Options{EnableCompression: true})
+			if err != nil {
+				log.Printf("websocket upgrade failed: %v", err)
+				return
+			}
+			defer conn.Close(websocket.CloseNormal, "")
+
+			for {
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := conn.WriteMessage(msgType, msg); err != nil {
+					return
+				}
+			}
+		}
 
 		if strings.HasPrefix(target, "/httpbin/") {
 			path := strings.TrimPrefix(target, "/httpbin")
@@ -53,7 +85,6 @@ func main() {
 			for {
 				n, readErr := resp.Body.Read(buf)
 				if n > 0 {
-					fmt.Println(n)
 					body = append(body, buf[:n]...)
 					if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
 						return
@@ -130,12 +161,25 @@ func main() {
 		_, _ = w.WriteBody(bodyBytes)
 	}
 
-	// 2. Pass the handler into Serve
-	srv, err := server.Serve(port, handler)
+	// 2. Pass the handler into Serve. TLS_CERT and TLS_KEY switch on HTTPS,
+	// where ALPN offers h2
+	opts := []server.Option{server.WithH2C(http2.Config{}), server.WithObserver(stats)}
+	if certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Error loading TLS key pair: %v", err)
+		}
+		opts = append(opts, server.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	}
+	chain := server.Chain(handler,
+		accesslog.New(accesslog.Options{Format: accesslog.FormatCombined}),
+		stats.Middleware(),
+		compress.New(compress.Options{}),
+	)
+	srv, err := server.Serve(port, chain, opts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer srv.Close()
 
 	log.Println("Server started on port", port)
 
@@ -143,5 +187,11 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not finish cleanly: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,213 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// Format picks how each request is written
+type Format int
+
+const (
+	// FormatText is slog's key=value output
+	FormatText Format = iota
+	// FormatJSON is one slog JSON object per request
+	FormatJSON
+	// FormatCommon is the Common Log Format
+	FormatCommon
+	// FormatCombined is the Common Log Format plus referer and user agent
+	FormatCombined
+)
+
+// clfTime is the timestamp layout of the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+type Options struct {
+	// Output defaults to os.Stderr
+	Output io.Writer
+	Format Format
+	// Logger, if set, receives the text and JSON formats instead of a
+	// handler over Output, so access logs can share the application's
+	// handler
+	Logger *slog.Logger
+	// Level defaults to slog.LevelInfo
+	Level slog.Level
+}
+
+func (o Options) withDefaults() Options {
+	if o.Output == nil {
+		o.Output = os.Stderr
+	}
+	if o.Logger == nil {
+		switch o.Format {
+		case FormatJSON:
+			o.Logger = slog.New(slog.NewJSONHandler(o.Output, nil))
+		case FormatText:
+			o.Logger = slog.New(slog.NewTextHandler(o.Output, nil))
+		}
+	}
+	return o
+}
+
+// entry is what gets logged about one request
+type entry struct {
+	start     time.Time
+	duration  time.Duration
+	method    string
+	target    string
+	proto     string
+	status    response.StatusCode
+	bytes     int
+	remote    string
+	client    string
+	user      string
+	userAgent string
+	referer   string
+	requestID string
+}
+
+// New returns middleware that logs every request once its handler returns
+func New(opts Options) server.Middleware {
+	opts = opts.withDefaults()
+	var mu sync.Mutex
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+
+			e := newEntry(w, req, start)
+			switch opts.Format {
+			case FormatCommon, FormatCombined:
+				line := e.clf(opts.Format == FormatCombined)
+				mu.Lock()
+				_, _ = io.WriteString(opts.Output, line)
+				mu.Unlock()
+			default:
+				opts.Logger.LogAttrs(context.Background(), opts.Level, "request", e.attrs()...)
+			}
+		}
+	}
+}
+
+func newEntry(w *response.Writer, req *request.Request, start time.Time) entry {
+	e := entry{
+		start:     start,
+		duration:  time.Since(start),
+		method:    string(req.RequestLine.Method),
+		target:    req.RequestLine.RequestTarget,
+		proto:     "HTTP/" + req.RequestLine.HttpVersion,
+		status:    w.Status(),
+		bytes:     w.BytesWritten(),
+		remote:    req.RemoteAddr,
+		client:    req.ClientIP,
+		user:      req.User(),
+		userAgent: req.Headers.Get("User-Agent"),
+		referer:   req.Headers.Get("Referer"),
+		requestID: req.RequestID(),
+	}
+	if e.client == "" {
+		e.client = e.remote
+		if host, _, err := net.SplitHostPort(e.remote); err == nil {
+			e.client = host
+		}
+	}
+	// Nothing upstream assigned an ID, so use the one the client or a
+	// proxy sent for correlating logs
+	if e.requestID == "" {
+		e.requestID = req.Headers.Get("X-Request-ID")
+	}
+	return e
+}
+
+func (e entry) attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("method", e.method),
+		slog.String("target", e.target),
+		slog.String("proto", e.proto),
+		slog.Int("status", int(e.status)),
+		slog.Int("bytes", e.bytes),
+		slog.Duration("duration", e.duration),
+		slog.String("remote_addr", e.remote),
+	}
+	if e.client != "" {
+		attrs = append(attrs, slog.String("client_ip", e.client))
+	}
+	if e.user != "" {
+		attrs = append(attrs, slog.String("user", e.user))
+	}
+	if e.userAgent != "" {
+		attrs = append(attrs, slog.String("user_agent", e.userAgent))
+	}
+	if e.requestID != "" {
+		attrs = append(attrs, slog.String("request_id", e.requestID))
+	}
+	return attrs
+}
+
+// clf formats the entry as
+//
+//	host ident authuser [date] "request line" status bytes
+//
+// with "referer" "user-agent" on the end for the combined format
+func (e entry) clf(combined bool) string {
+	var b strings.Builder
+	b.WriteString(orDash(e.client))
+	b.WriteString(" - ")
+	b.WriteString(orDash(quote(e.user)))
+	b.WriteString(" [")
+	b.WriteString(e.start.Format(clfTime))
+	b.WriteString(`] "`)
+	b.WriteString(quote(e.method + " " + e.target + " " + e.proto))
+	b.WriteString(`" `)
+	b.WriteString(strconv.Itoa(int(e.status)))
+	b.WriteByte(' ')
+	if e.bytes > 0 {
+		b.WriteString(strconv.Itoa(e.bytes))
+	} else {
+		b.WriteByte('-')
+	}
+	if combined {
+		fmt.Fprintf(&b, ` "%s" "%s"`, orDash(quote(e.referer)), orDash(quote(e.userAgent)))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote escapes quotes, backslashes and control characters so values taken
+// from the request cannot break a line apart or forge another
+func quote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w *response.Writer, req *request.Request) {
+	body := []byte("hello")
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+func serve(t *testing.T, h server.Handler, raw string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:4000"
+	h(response.NewWriter(io.Discard), req)
+}
+
+const get = "GET /a?b=1 HTTP/1.1\r\nHost: localhost\r\nUser-Agent: curl/8.0\r\n" +
+	"Referer: http://example.com/\r\nX-Request-ID: abc-123\r\n\r\n"
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	serve(t, New(Options{Output: &out, Format: FormatJSON})(hello), get)
+
+	// Test: One JSON object per request with every field
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+	assert.Equal(t, "request", rec["msg"])
+	assert.Equal(t, "GET", rec["method"])
+	assert.Equal(t, "/a?b=1", rec["target"])
+	assert.Equal(t, "HTTP/1.1", rec["proto"])
+	assert.EqualValues(t, 200, rec["status"])
+	assert.EqualValues(t, 5, rec["bytes"])
+	assert.Contains(t, rec, "duration")
+	assert.Equal(t, "192.0.2.1:4000", rec["remote_addr"])
+	assert.Equal(t, "192.0.2.1", rec["client_ip"])
+	assert.Equal(t, "curl/8.0", rec["user_agent"])
+	assert.Equal(t, "abc-123", rec["request_id"])
+	assert.NotContains(t, rec, "user")
+}
+
+func TestText(t *testing.T) {
+	var out bytes.Buffer
+	h := New(Options{Output: &out})(func(w *response.Writer, req *request.Request) {
+		req.SetRequestID("req-1")
+		_ = w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		delete(h, "content-length")
+		h.Set("Transfer-Encoding", "chunked")
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteChunkedBody([]byte("abc"))
+		_, _ = w.WriteChunkedBody([]byte("defg"))
+		_, _ = w.WriteChunkedBodyDone()
+	})
+	serve(t, h, get)
+
+	// Test: Chunked bodies are counted without their framing, and an ID set
+	// on the request wins over the header
+	line := out.String()
+	assert.Contains(t, line, "msg=request method=GET")
+	assert.Contains(t, line, " bytes=7 ")
+	assert.Contains(t, line, " request_id=req-1")
+}
+
+func TestCommon(t *testing.T) {
+	var out bytes.Buffer
+	h := New(Options{Output: &out, Format: FormatCommon})(func(w *response.Writer, req *request.Request) {
+		req.SetUser("ada")
+		_ = w.WriteError(response.StatusBadRequest, nil)
+	})
+	serve(t, h, get)
+
+	// Test: Common Log Format
+	assert.Regexp(t,
+		regexp.MustCompile(`^192\.0\.2\.1 - ada \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=1 HTTP/1\.1" 400 16\n$`),
+		out.String())
+}
+
+func TestCombined(t *testing.T) {
+	var out bytes.Buffer
+	h := New(Options{Output: &out, Format: FormatCombined})(func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusNoContent)
+		_ = w.WriteHeaders(nil)
+	})
+	serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: evil\" 200 1\tx\r\n\r\n")
+
+	// Test: Combined adds referer and user agent, empty fields are dashes
+	// and quotes in request values are escaped
+	assert.True(t, strings.HasSuffix(out.String(), `"GET / HTTP/1.1" 204 - "-" "evil\" 200 1\x09x"`+"\n"), out.String())
+}
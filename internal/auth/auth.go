@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var (
+	ErrMissing     = errors.New("no credentials")
+	ErrInvalid     = errors.New("invalid credentials")
+	ErrExpired     = errors.New("credentials have expired")
+	ErrReplayed    = errors.New("request was already seen")
+	ErrUnknownKey  = errors.New("unknown signing key")
+	ErrBadEncoding = errors.New("malformed Authorization header")
+)
+
+// Identity is who a request was authenticated as
+type Identity struct {
+	// Subject is the user name, token subject or key ID
+	Subject string
+	// Scheme is the authentication scheme that succeeded, such as "Basic"
+	Scheme string
+}
+
+type identityKey struct{}
+
+// SetIdentity records who req was authenticated as. The subject also
+// becomes the request's User
+func SetIdentity(req *request.Request, id Identity) {
+	req.SetValue(identityKey{}, id)
+	req.SetUser(id.Subject)
+}
+
+// IdentityFrom returns the identity an auth middleware attached to req
+func IdentityFrom(req *request.Request) (Identity, bool) {
+	id, ok := req.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// credentials splits the Authorization header into its scheme and the rest.
+// Scheme names are case-insensitive (RFC 9110 11.1)
+func credentials(req *request.Request, scheme string) (string, error) {
+	name, rest, _ := strings.Cut(req.Headers.Get("Authorization"), " ")
+	if !strings.EqualFold(name, scheme) {
+		return "", ErrMissing
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return "", ErrBadEncoding
+	}
+	return rest, nil
+}
+
+// unauthorized sends 401 with a WWW-Authenticate challenge
+func unauthorized(w *response.Writer, challenge string) {
+	h := response.Headers{}
+	h.Set("WWW-Authenticate", challenge)
+	_ = w.WriteError(response.StatusUnauthorized, h)
+}
+
+// secureCompare compares in time that depends on neither the contents nor
+// the lengths of a and b
+func secureCompare(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// whoami answers with the identity the middleware attached
+func whoami(w *response.Writer, req *request.Request) {
+	id, _ := IdentityFrom(req)
+	body := []byte(id.Scheme + " " + id.Subject)
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+func do(t *testing.T, h server.Handler, method, target, authorization, body string) (*http.Response, string) {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	if authorization != "" {
+		raw += "Authorization: " + authorization + "\r\n"
+	}
+	raw += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	return serveRaw(t, h, raw)
+}
+
+func serveRaw(t *testing.T, h server.Handler, raw string) (*http.Response, string) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	h(response.NewWriter(&out), req)
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(b)
+}
+
+func basic(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestBasic(t *testing.T) {
+	h := Basic(BasicOptions{
+		Credentials: StaticCredentials(map[string]string{"ada": "lovelace"}),
+		Realm:       "admin",
+	})(whoami)
+
+	// Test: Good credentials reach the handler with an identity
+	resp, body := do(t, h, "GET", "/", basic("ada", "lovelace"), "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Basic ada", body)
+	_, body = do(t, h, "GET", "/", "basic "+strings.TrimPrefix(basic("ada", "lovelace"), "Basic "), "")
+	assert.Equal(t, "Basic ada", body, "scheme is case-insensitive")
+
+	// Test: Everything else gets a challenge
+	for _, authz := range []string{
+		"",
+		basic("ada", "wrong"),
+		basic("ada", ""),
+		basic("grace", "lovelace"),
+		"Basic !!!",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("no-colon")),
+		"Bearer lovelace",
+	} {
+		resp, _ := do(t, h, "GET", "/", authz, "")
+		assert.Equal(t, 401, resp.StatusCode, authz)
+		assert.Equal(t, `Basic realm="admin", charset="UTF-8"`, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	// Test: Missing credentials are caught when the middleware is built
+	assert.Panics(t, func() { Basic(BasicOptions{}) })
+}
+
+func TestBearer(t *testing.T) {
+	h := Bearer(BearerOptions{Validate: func(token string) (string, error) {
+		if token == "s3cret" {
+			return "svc-a", nil
+		}
+		return "", errors.New("unknown token")
+	}})(whoami)
+
+	resp, body := do(t, h, "GET", "/", "Bearer s3cret", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Bearer svc-a", body)
+
+	// Test: The challenge distinguishes missing, malformed and bad tokens
+	cases := map[string]string{
+		"":              `Bearer realm="restricted"`,
+		"Bearer ":       `Bearer realm="restricted", error="invalid_request"`,
+		"Bearer nope":   `Bearer realm="restricted", error="invalid_token"`,
+		basic("a", "b"): `Bearer realm="restricted"`,
+	}
+	for authz, challenge := range cases {
+		resp, _ := do(t, h, "GET", "/", authz, "")
+		assert.Equal(t, 401, resp.StatusCode, authz)
+		assert.Equal(t, challenge, resp.Header.Get("WWW-Authenticate"), authz)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	key := []byte("shared secret")
+	h := HMAC(HMACOptions{Keys: func(id string) ([]byte, bool) {
+		return key, id == "k1"
+	}})(whoami)
+	now := time.Now()
+
+	// Test: A signed request is accepted once
+	authz := Sign("k1", key, "POST", "/orders?dry=1", []byte(`{"qty":2}`), now, "n-1")
+	resp, body := do(t, h, "POST", "/orders?dry=1", authz, `{"qty":2}`)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "HMAC-SHA256 k1", body)
+	resp, _ = do(t, h, "POST", "/orders?dry=1", authz, `{"qty":2}`)
+	assert.Equal(t, 401, resp.StatusCode, "replay")
+	assert.Equal(t, `HMAC-SHA256 realm="restricted"`, resp.Header.Get("WWW-Authenticate"))
+
+	// Test: Changing anything that was signed breaks the signature
+	authz = Sign("k1", key, "POST", "/orders", []byte(`{"qty":2}`), now, "n-2")
+	for _, tc := range []struct{ method, target, body string }{
+		{"PUT", "/orders", `{"qty":2}`},
+		{"POST", "/orders?x", `{"qty":2}`},
+		{"POST", "/orders", `{"qty":200}`},
+	} {
+		resp, _ := do(t, h, tc.method, tc.target, authz, tc.body)
+		assert.Equal(t, 401, resp.StatusCode, tc)
+	}
+
+	// Test: Old or future timestamps, unknown keys and wrong keys fail
+	for _, authz := range []string{
+		Sign("k1", key, "GET", "/", nil, now.Add(-10*time.Minute), "n-3"),
+		Sign("k1", key, "GET", "/", nil, now.Add(10*time.Minute), "n-4"),
+		Sign("k2", key, "GET", "/", nil, now, "n-5"),
+		Sign("k1", []byte("guess"), "GET", "/", nil, now, "n-6"),
+		`HMAC-SHA256 keyId="k1"`,
+	} {
+		resp, _ := do(t, h, "GET", "/", authz, "")
+		assert.Equal(t, 401, resp.StatusCode, authz)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+	c := &nonceCache{seen: map[string]time.Time{}, max: 2}
+	assert.True(t, c.add("a", now.Add(time.Minute), now))
+	assert.False(t, c.add("a", now.Add(time.Minute), now))
+	assert.True(t, c.add("b", now.Add(time.Second), now))
+
+	// Test: A full cache refuses until entries expire
+	assert.False(t, c.add("c", now.Add(time.Minute), now))
+	assert.True(t, c.add("c", now.Add(time.Minute), now.Add(2*time.Second)))
+	assert.Len(t, c.seen, 2)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// CredentialProvider looks up the password for a user name
+type CredentialProvider func(user string) (password string, ok bool)
+
+// StaticCredentials serves passwords from a fixed map of user to password
+func StaticCredentials(users map[string]string) CredentialProvider {
+	return func(user string) (string, bool) {
+		pass, ok := users[user]
+		return pass, ok
+	}
+}
+
+type BasicOptions struct {
+	// Credentials is required
+	Credentials CredentialProvider
+	// Realm is sent in the challenge. Empty means "restricted"
+	Realm string
+}
+
+// Basic returns middleware that requires HTTP Basic credentials (RFC 7617).
+// Unknown users are compared against a dummy password so the response time
+// does not reveal which user names exist. It panics without Credentials,
+// so the mistake shows at startup instead of on the first request
+func Basic(opts BasicOptions) server.Middleware {
+	if opts.Credentials == nil {
+		panic("auth: Basic needs BasicOptions.Credentials")
+	}
+	if opts.Realm == "" {
+		opts.Realm = "restricted"
+	}
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", opts.Realm)
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			user, err := checkBasic(req, opts.Credentials)
+			if err != nil {
+				unauthorized(w, challenge)
+				return
+			}
+			SetIdentity(req, Identity{Subject: user, Scheme: "Basic"})
+			next(w, req)
+		}
+	}
+}
+
+func checkBasic(req *request.Request, provider CredentialProvider) (string, error) {
+	encoded, err := credentials(req, "Basic")
+	if err != nil {
+		return "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrBadEncoding
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", ErrBadEncoding
+	}
+
+	want, known := provider(user)
+	if !known {
+		want = "\x00unknown user"
+	}
+	if !secureCompare(pass, want) || !known {
+		return "", ErrInvalid
+	}
+	return user, nil
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// TokenValidator checks a bearer token and returns the subject it was
+// issued to
+type TokenValidator func(token string) (subject string, err error)
+
+type BearerOptions struct {
+	Validate TokenValidator
+	// Realm is sent in the challenge. Empty means "restricted"
+	Realm string
+}
+
+// Bearer returns middleware that requires a bearer token (RFC 6750). The
+// challenge says invalid_token when a token was sent but rejected, so
+// clients know to fetch a new one
+func Bearer(opts BearerOptions) server.Middleware {
+	if opts.Realm == "" {
+		opts.Realm = "restricted"
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			subject, err := checkBearer(req, opts.Validate)
+			if err != nil {
+				unauthorized(w, bearerChallenge(opts.Realm, err))
+				return
+			}
+			SetIdentity(req, Identity{Subject: subject, Scheme: "Bearer"})
+			next(w, req)
+		}
+	}
+}
+
+func checkBearer(req *request.Request, validate TokenValidator) (string, error) {
+	token, err := credentials(req, "Bearer")
+	if err != nil {
+		return "", err
+	}
+	subject, err := validate(token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return subject, nil
+}
+
+func bearerChallenge(realm string, err error) string {
+	switch {
+	case errors.Is(err, ErrMissing):
+		return fmt.Sprintf("Bearer realm=%q", realm)
+	case errors.Is(err, ErrBadEncoding):
+		return fmt.Sprintf("Bearer realm=%q, error=\"invalid_request\"", realm)
+	}
+	return fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", realm)
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// HMACScheme is the Authorization scheme for signed requests. The header
+// looks like:
+//
+//	Authorization: HMAC-SHA256 keyId="k1", timestamp="1700000000", nonce="n", signature="base64"
+//
+// The signature covers the method, target, timestamp, nonce and a SHA-256
+// of the body, each on its own line
+const HMACScheme = "HMAC-SHA256"
+
+// KeyProvider looks up the shared secret for a key ID
+type KeyProvider func(keyID string) (key []byte, ok bool)
+
+type HMACOptions struct {
+	Keys KeyProvider
+	// MaxSkew is how far the timestamp may be from the server clock.
+	// Default 5 minutes
+	MaxSkew time.Duration
+	// MaxNonces bounds how many nonces are remembered. Once full, signed
+	// requests are refused until old nonces age out. Default 100000
+	MaxNonces int
+	// Realm is sent in the challenge. Empty means "restricted"
+	Realm string
+}
+
+func (o HMACOptions) withDefaults() HMACOptions {
+	if o.MaxSkew == 0 {
+		o.MaxSkew = 5 * time.Minute
+	}
+	if o.MaxNonces == 0 {
+		o.MaxNonces = 100000
+	}
+	if o.Realm == "" {
+		o.Realm = "restricted"
+	}
+	return o
+}
+
+// HMAC returns middleware that requires requests signed with a shared key.
+// Requests outside the clock skew window are rejected outright and nonces
+// are remembered for as long as their timestamp is acceptable, so a
+// captured request cannot be replayed
+func HMAC(opts HMACOptions) server.Middleware {
+	opts = opts.withDefaults()
+	nonces := &nonceCache{seen: map[string]time.Time{}, max: opts.MaxNonces}
+	challenge := fmt.Sprintf("%s realm=%q", HMACScheme, opts.Realm)
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			keyID, err := checkHMAC(req, opts, nonces)
+			if err != nil {
+				unauthorized(w, challenge)
+				return
+			}
+			SetIdentity(req, Identity{Subject: keyID, Scheme: HMACScheme})
+			next(w, req)
+		}
+	}
+}
+
+// Sign returns the Authorization value for a request, for use by clients
+func Sign(keyID string, key []byte, method, target string, body []byte, ts time.Time, nonce string) string {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := signature(key, method, target, timestamp, nonce, body)
+	return fmt.Sprintf("%s keyId=%q, timestamp=%q, nonce=%q, signature=%q",
+		HMACScheme, keyID, timestamp, nonce, base64.StdEncoding.EncodeToString(sig))
+}
+
+func signature(key []byte, method, target, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, target, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return mac.Sum(nil)
+}
+
+func checkHMAC(req *request.Request, opts HMACOptions, nonces *nonceCache) (string, error) {
+	raw, err := credentials(req, HMACScheme)
+	if err != nil {
+		return "", err
+	}
+	params, err := parseParams(raw)
+	if err != nil {
+		return "", err
+	}
+	keyID, timestamp, nonce := params["keyId"], params["timestamp"], params["nonce"]
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if keyID == "" || nonce == "" || err != nil {
+		return "", ErrBadEncoding
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrBadEncoding
+	}
+
+	now := time.Now()
+	ts := time.Unix(unix, 0)
+	if ts.Before(now.Add(-opts.MaxSkew)) || ts.After(now.Add(opts.MaxSkew)) {
+		return "", ErrExpired
+	}
+
+	key, ok := opts.Keys(keyID)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	want := signature(key, string(req.RequestLine.Method), req.RequestLine.RequestTarget, timestamp, nonce, req.Body)
+	if !hmac.Equal(sig, want) {
+		return "", ErrInvalid
+	}
+
+	// Only signed requests get this far, so strangers cannot fill the cache
+	if !nonces.add(keyID+"\x00"+nonce, ts.Add(opts.MaxSkew), now) {
+		return "", ErrReplayed
+	}
+	return keyID, nil
+}
+
+// parseParams reads comma-separated name="value" pairs (RFC 9110 11.2)
+func parseParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, ErrBadEncoding
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+// nonceCache remembers nonces until the timestamps they came with fall out
+// of the skew window
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	max  int
+}
+
+// add records nonce and reports whether it was new
+func (c *nonceCache) add(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp, ok := c.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	if len(c.seen) >= c.max {
+		for n, exp := range c.seen {
+			if !now.Before(exp) {
+				delete(c.seen, n)
+			}
+		}
+		if len(c.seen) >= c.max {
+			return false
+		}
+	}
+	c.seen[nonce] = expires
+	return true
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrJWKS = errors.New("invalid JWKS")
+
+// jwk is a single key from a JWK Set (RFC 7517). Only the members needed
+// for HS256, RS256 and ES256 are read
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// oct
+	K string `json:"k"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed key and the one algorithm it may be used with,
+// so an RSA public key can never be fed to HS256 as a secret
+type verificationKey struct {
+	kid string
+	alg string
+	key any
+}
+
+// parseJWKS reads the keys in a JWK Set document. Keys for other uses or
+// algorithms are skipped
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrJWKS, err)
+	}
+	var keys []verificationKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		vk, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %v", ErrJWKS, k.Kid, err)
+		}
+		if vk.alg == "" || (k.Alg != "" && k.Alg != vk.alg) {
+			continue
+		}
+		keys = append(keys, vk)
+	}
+	return keys, nil
+}
+
+func (k jwk) parse() (verificationKey, error) {
+	b64 := base64.RawURLEncoding
+	vk := verificationKey{kid: k.Kid}
+	switch k.Kty {
+	case "oct":
+		secret, err := b64.DecodeString(k.K)
+		if err != nil || len(secret) < 32 {
+			return vk, errors.New("HS256 secrets need at least 32 bytes")
+		}
+		vk.alg, vk.key = "HS256", secret
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return vk, errors.New("bad RSA modulus or exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return vk, errors.New("RSA keys need at least 2048 bits")
+		}
+		vk.alg, vk.key = "RS256", pub
+	case "EC":
+		if k.Crv != "P-256" {
+			return vk, nil
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return vk, errors.New("bad EC coordinates")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return vk, err
+		}
+		vk.alg, vk.key = "ES256", pub
+	}
+	return vk, nil
+}
+
+// KeySet holds the keys tokens are verified with, loaded from a JWKS file.
+// The file is checked for changes once per interval, and sooner (but no
+// more than ten times per interval) when a token names a key it does not
+// know, so rotating keys only needs the file to be replaced
+type KeySet struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.Mutex
+	keys      []verificationKey
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// LoadJWKS reads the JWKS file at path. Interval zero means a minute
+func LoadJWKS(path string, interval time.Duration) (*KeySet, error) {
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ks := &KeySet{path: path, interval: interval}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// reload reads the file if it changed since the last load. The caller holds
+// the lock, except in LoadJWKS
+func (ks *KeySet) reload() error {
+	ks.lastCheck = time.Now()
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(ks.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	ks.keys, ks.modTime = keys, info.ModTime()
+	return nil
+}
+
+// lookup returns the keys a token with this kid and alg may be checked
+// against. Reload errors keep the keys already loaded
+func (ks *KeySet) lookup(kid, alg string) []verificationKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	due := time.Since(ks.lastCheck) >= ks.interval
+	if due {
+		_ = ks.reload()
+	}
+	found := ks.match(kid, alg)
+	if len(found) == 0 && kid != "" && !due && time.Since(ks.lastCheck) >= ks.interval/10 {
+		// The token may be signed with a key published since the last check
+		_ = ks.reload()
+		found = ks.match(kid, alg)
+	}
+	return found
+}
+
+func (ks *KeySet) match(kid, alg string) []verificationKey {
+	var found []verificationKey
+	for _, k := range ks.keys {
+		if k.alg == alg && (kid == "" || k.kid == kid) {
+			found = append(found, k)
+		}
+	}
+	return found
+}
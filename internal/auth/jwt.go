@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/cookie"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+var ErrNotYetValid = errors.New("token is not valid yet")
+
+// Claims is a decoded JWT claims set. Numbers are json.Number
+type Claims map[string]any
+
+// GetString returns a string claim, or "" if it is missing or not a string
+func (c Claims) GetString(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c Claims) Subject() string { return c.GetString("sub") }
+func (c Claims) Issuer() string  { return c.GetString("iss") }
+
+// Time reads a NumericDate claim such as exp
+func (c Claims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// Audience returns aud, which may be a single string or an array
+func (c Claims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		var out []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+type claimsKey struct{}
+
+// ClaimsFrom returns the claims the JWT middleware verified for req
+func ClaimsFrom(req *request.Request) (Claims, bool) {
+	c, ok := req.Value(claimsKey{}).(Claims)
+	return c, ok
+}
+
+type JWTOptions struct {
+	// Keys is required
+	Keys *KeySet
+	// Algorithms lists the accepted algorithms. Default HS256, RS256 and
+	// ES256
+	Algorithms []string
+	// Issuer, when set, must equal the iss claim
+	Issuer string
+	// Audience, when set, must appear in the aud claim
+	Audience string
+	// Leeway allows for clock skew on exp and nbf. Default 1 minute
+	Leeway time.Duration
+	// Cookie names a cookie to read the token from when there is no
+	// Authorization header
+	Cookie string
+	// Realm is sent in the challenge. Empty means "restricted"
+	Realm string
+}
+
+func (o JWTOptions) withDefaults() JWTOptions {
+	if len(o.Algorithms) == 0 {
+		o.Algorithms = []string{"HS256", "RS256", "ES256"}
+	}
+	if o.Leeway == 0 {
+		o.Leeway = time.Minute
+	}
+	if o.Realm == "" {
+		o.Realm = "restricted"
+	}
+	return o
+}
+
+// JWT returns middleware that requires a signed JWT (RFC 7519) and attaches
+// its claims to the request for ClaimsFrom
+func JWT(opts JWTOptions) server.Middleware {
+	opts = opts.withDefaults()
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			token, err := jwtFromRequest(req, opts.Cookie)
+			if err == nil {
+				var claims Claims
+				if claims, err = VerifyJWT(token, opts); err == nil {
+					req.SetValue(claimsKey{}, claims)
+					SetIdentity(req, Identity{Subject: claims.Subject(), Scheme: "Bearer"})
+					next(w, req)
+					return
+				}
+			}
+			unauthorized(w, bearerChallenge(opts.Realm, err))
+		}
+	}
+}
+
+func jwtFromRequest(req *request.Request, cookieName string) (string, error) {
+	token, err := credentials(req, "Bearer")
+	if err != ErrMissing || cookieName == "" {
+		return token, err
+	}
+	c, err := cookie.Get(req, cookieName)
+	if err != nil || c.Value == "" {
+		return "", ErrMissing
+	}
+	return c.Value, nil
+}
+
+// VerifyJWT checks a compact JWS token's signature and registered claims
+// and returns its claims
+func VerifyJWT(token string, opts JWTOptions) (Claims, error) {
+	opts = opts.withDefaults()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: token needs three parts", ErrBadEncoding)
+	}
+
+	var header struct {
+		Alg  string `json:"alg"`
+		Kid  string `json:"kid"`
+		Crit []any  `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// "none" and anything else unexpected never reach a key
+	if !slices.Contains(opts.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("%w: algorithm %q not accepted", ErrInvalid, header.Alg)
+	}
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("%w: unsupported critical header", ErrInvalid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBadEncoding
+	}
+
+	keys := opts.Keys.lookup(header.Kid, header.Alg)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, header.Kid)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(k verificationKey) bool { return verifySignature(k, signed, sig) }) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalid)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := checkClaims(claims, opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrBadEncoding
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadEncoding, err)
+	}
+	return nil
+}
+
+func verifySignature(k verificationKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS carries R and S as fixed-size big-endian halves (RFC 7518 3.4)
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+func checkClaims(c Claims, opts JWTOptions) error {
+	now := time.Now()
+	if _, present := c["exp"]; present {
+		exp, ok := c.Time("exp")
+		if !ok {
+			return fmt.Errorf("%w: exp is not a number", ErrInvalid)
+		}
+		if now.After(exp.Add(opts.Leeway)) {
+			return ErrExpired
+		}
+	}
+	if _, present := c["nbf"]; present {
+		nbf, ok := c.Time("nbf")
+		if !ok {
+			return fmt.Errorf("%w: nbf is not a number", ErrInvalid)
+		}
+		if now.Add(opts.Leeway).Before(nbf) {
+			return ErrNotYetValid
+		}
+	}
+	if opts.Issuer != "" && c.Issuer() != opts.Issuer {
+		return fmt.Errorf("%w: issuer %q", ErrInvalid, c.Issuer())
+	}
+	if opts.Audience != "" && !slices.Contains(c.Audience(), opts.Audience) {
+		return fmt.Errorf("%w: audience", ErrInvalid)
+	}
+	return nil
+}
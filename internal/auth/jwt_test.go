@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var b64 = base64.RawURLEncoding
+
+// testKeys are one key of each supported type
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return testKeys{secret: secret, rsa: rk, ec: ek}
+}
+
+// jwks renders the keys as a JWK Set, with kid prefix p
+func (k testKeys) jwks(p string) []byte {
+	ecPub, _ := k.ec.PublicKey.Bytes()
+	doc := map[string]any{"keys": []map[string]string{
+		{"kid": p + "hs", "kty": "oct", "k": b64.EncodeToString(k.secret)},
+		{"kid": p + "rs", "kty": "RSA", "alg": "RS256", "use": "sig",
+			"n": b64.EncodeToString(k.rsa.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kid": p + "es", "kty": "EC", "crv": "P-256",
+			"x": b64.EncodeToString(ecPub[1:33]), "y": b64.EncodeToString(ecPub[33:])},
+		{"kid": p + "enc", "kty": "RSA", "use": "enc"},
+	}}
+	out, _ := json.Marshal(doc)
+	return out
+}
+
+func (k testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, path string, data []byte, mtime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, keys.jwks("a-"), time.Now())
+	ks, err := LoadJWKS(path, 0)
+	require.NoError(t, err)
+
+	opts := JWTOptions{Keys: ks, Issuer: "https://id.example", Audience: "api", Cookie: "token"}
+	h := JWT(opts)(whoami)
+	now := time.Now().Unix()
+	good := map[string]any{"sub": "ada", "iss": "https://id.example", "aud": []string{"web", "api"}, "exp": now + 60}
+
+	// Test: Each algorithm verifies with its key
+	for alg, kid := range map[string]string{"HS256": "a-hs", "RS256": "a-rs", "ES256": "a-es"} {
+		resp, body := do(t, h, "GET", "/", "Bearer "+keys.sign(t, alg, kid, good), "")
+		assert.Equal(t, 200, resp.StatusCode, alg)
+		assert.Equal(t, "Bearer ada", body, alg)
+	}
+
+	// Test: Claims are attached to the request
+	claims, err := VerifyJWT(keys.sign(t, "ES256", "a-es", good), opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web", "api"}, claims.Audience())
+	exp, ok := claims.Time("exp")
+	require.True(t, ok)
+	assert.Equal(t, now+60, exp.Unix())
+
+	// Test: Registered claims are checked, with leeway for clock skew
+	with := func(k string, v any) map[string]any {
+		c := map[string]any{}
+		for k, v := range good {
+			c[k] = v
+		}
+		c[k] = v
+		return c
+	}
+	cases := map[string]struct {
+		claims map[string]any
+		err    error
+	}{
+		"expired":        {with("exp", now-120), ErrExpired},
+		"within leeway":  {with("exp", now-30), nil},
+		"not yet valid":  {with("nbf", now+120), ErrNotYetValid},
+		"nbf in leeway":  {with("nbf", now+30), nil},
+		"wrong issuer":   {with("iss", "https://evil.example"), ErrInvalid},
+		"wrong audience": {with("aud", "web"), ErrInvalid},
+		"exp not number": {with("exp", "tomorrow"), ErrInvalid},
+	}
+	for name, tc := range cases {
+		_, err := VerifyJWT(keys.sign(t, "HS256", "a-hs", tc.claims), opts)
+		if tc.err == nil {
+			assert.NoError(t, err, name)
+		} else {
+			assert.ErrorIs(t, err, tc.err, name)
+		}
+	}
+
+	// Test: Algorithm confusion and tampering are refused
+	rsToken := keys.sign(t, "RS256", "a-rs", good)
+	_, err = VerifyJWT(keys.sign(t, "HS256", "a-rs", good), opts)
+	require.ErrorIs(t, err, ErrUnknownKey, "HS256 with an RSA kid")
+	none := b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"sub":"root"}`)) + "."
+	_, err = VerifyJWT(none, opts)
+	require.ErrorIs(t, err, ErrInvalid)
+	tampered := rsToken[:len(rsToken)-4] + "AAAA"
+	_, err = VerifyJWT(tampered, opts)
+	require.ErrorIs(t, err, ErrInvalid)
+	_, err = VerifyJWT(keys.sign(t, "RS256", "a-enc", good), opts)
+	require.ErrorIs(t, err, ErrUnknownKey, "encryption keys are not used")
+	_, err = VerifyJWT("a.b", opts)
+	require.ErrorIs(t, err, ErrBadEncoding)
+
+	// Test: The token can come from a cookie
+	raw := "GET / HTTP/1.1\r\nHost: x\r\nCookie: token=" + keys.sign(t, "ES256", "a-es", good) + "\r\n\r\n"
+	resp, body := serveRaw(t, h, raw)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Bearer ada", body)
+
+	// Test: Failures carry a Bearer challenge
+	resp, _ = do(t, h, "GET", "/", "Bearer "+keys.sign(t, "HS256", "a-hs", with("exp", now-120)), "")
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="restricted", error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+	resp, _ = do(t, h, "GET", "/", "", "")
+	assert.Equal(t, `Bearer realm="restricted"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKeys, newKeys := newTestKeys(t), newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, oldKeys.jwks("old-"), time.Now().Add(-time.Hour))
+	ks, err := LoadJWKS(path, 50*time.Millisecond)
+	require.NoError(t, err)
+	opts := JWTOptions{Keys: ks}
+	claims := map[string]any{"sub": "ada"}
+
+	_, err = VerifyJWT(oldKeys.sign(t, "ES256", "old-es", claims), opts)
+	require.NoError(t, err)
+
+	// Test: A token under a newly published key is picked up early
+	writeJWKS(t, path, newKeys.jwks("new-"), time.Now())
+	time.Sleep(10 * time.Millisecond)
+	_, err = VerifyJWT(newKeys.sign(t, "ES256", "new-es", claims), opts)
+	require.NoError(t, err)
+
+	// Test: Keys dropped from the file stop working
+	_, err = VerifyJWT(oldKeys.sign(t, "ES256", "old-es", claims), opts)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	// Test: A broken file keeps the last good keys
+	writeJWKS(t, path, []byte("{"), time.Now().Add(time.Minute))
+	time.Sleep(60 * time.Millisecond)
+	_, err = VerifyJWT(newKeys.sign(t, "ES256", "new-es", claims), opts)
+	require.NoError(t, err)
+
+	// Test: Weak keys are refused when loading
+	writeJWKS(t, path, []byte(`{"keys":[{"kty":"oct","k":"c2hvcnQ"}]}`), time.Now())
+	_, err = LoadJWKS(path, 0)
+	require.ErrorIs(t, err, ErrJWKS)
+}
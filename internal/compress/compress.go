@@ -0,0 +1,310 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// Encoding is one content-coding the middleware can produce
+type Encoding struct {
+	// Name is the token used in Accept-Encoding and Content-Encoding
+	Name string
+	// NewWriter wraps w so that everything written to it is compressed
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Gzip returns the gzip coding at the given compress/gzip level
+func Gzip(level int) Encoding {
+	return Encoding{
+		Name: "gzip",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+	}
+}
+
+// Deflate returns the deflate coding, which HTTP defines as the zlib
+// format (RFC 9110 8.4.1.2) rather than a raw deflate stream
+func Deflate(level int) Encoding {
+	return Encoding{
+		Name: "deflate",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+	}
+}
+
+// DefaultSkipTypes are media types whose payloads are already compressed.
+// Entries ending in "/" match every subtype
+var DefaultSkipTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+type Options struct {
+	// Encodings in order of preference. Nil means gzip, then deflate
+	Encodings []Encoding
+	// MinSize leaves responses with a smaller Content-Length alone. Zero
+	// means 1024. Responses without a length are always candidates
+	MinSize int
+	// SkipTypes overrides DefaultSkipTypes
+	SkipTypes []string
+}
+
+func (o Options) withDefaults() Options {
+	if o.Encodings == nil {
+		o.Encodings = []Encoding{Gzip(gzip.DefaultCompression), Deflate(zlib.DefaultCompression)}
+	}
+	if o.MinSize == 0 {
+		o.MinSize = 1024
+	}
+	if o.SkipTypes == nil {
+		o.SkipTypes = DefaultSkipTypes
+	}
+	return o
+}
+
+// New returns middleware that compresses response bodies using the best
+// coding the client accepts
+func New(opts Options) server.Middleware {
+	opts = opts.withDefaults()
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			// HEAD responses carry no body to compress, and upgrades and
+			// tunnels need the real connection writer to hijack. Proxied
+			// absolute-form requests are relayed as the origin sent them
+			if req.RequestLine.Method == request.MethodHead ||
+				req.RequestLine.Method == request.MethodConnect ||
+				req.Headers.HasToken("Connection", "upgrade") ||
+				!strings.HasPrefix(req.RequestLine.RequestTarget, "/") {
+				next(w, req)
+				return
+			}
+
+			cw := &compressWriter{
+				out:  w,
+				opts: &opts,
+				enc:  negotiate(req.Headers.Get("Accept-Encoding"), opts.Encodings),
+			}
+			inner := response.NewSinkWriter(cw)
+			next(inner, req)
+			cw.finish(inner.Complete())
+		}
+	}
+}
+
+// compressWriter sits between the handler's Writer and the real one. It
+// decides per response whether to compress once the headers are known
+type compressWriter struct {
+	out  *response.Writer
+	opts *Options
+	enc  *Encoding
+
+	zw io.WriteCloser
+	// bw gathers the compressor's many small writes into full chunks
+	bw *bufio.Writer
+	// chunked is set when out is writing a chunked body
+	chunked bool
+	// streaming is set when the handler itself sent a chunked body, so
+	// each write is flushed instead of waiting for a full block
+	streaming bool
+	ended     bool
+}
+
+func (c *compressWriter) WriteHeader(status response.StatusCode, h response.Headers) error {
+	h = maps.Clone(h)
+	if h == nil {
+		h = response.Headers{}
+	}
+	handlerChunked := h.HasToken("Transfer-Encoding", "chunked")
+	c.chunked = handlerChunked
+
+	if c.eligible(status, h) {
+		addVary(h)
+		if c.enc != nil {
+			c.bw = bufio.NewWriter(chunkWriter{c.out})
+			zw, err := c.enc.NewWriter(c.bw)
+			if err != nil {
+				return err
+			}
+			c.zw = zw
+			c.chunked = true
+			c.streaming = handlerChunked
+			delete(h, "content-length")
+			h.Set("Content-Encoding", c.enc.Name)
+			h.Set("Transfer-Encoding", "chunked")
+			// The compressed bytes differ, so a strong validator no
+			// longer applies
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	if err := c.out.WriteStatusLine(status); err != nil {
+		return err
+	}
+	return c.out.WriteHeaders(h)
+}
+
+// eligible reports whether a response with status and h could be
+// compressed for some client, which is also when it needs Vary
+func (c *compressWriter) eligible(status response.StatusCode, h response.Headers) bool {
+	switch {
+	case status < 200, status == response.StatusNoContent,
+		status == response.StatusPartialContent, status == response.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "":
+		return false
+	}
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil && cl < c.opts.MinSize {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, skip := range c.opts.SkipTypes {
+		if mediaType == skip || strings.HasSuffix(skip, "/") && strings.HasPrefix(mediaType, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compressWriter) WriteData(p []byte) error {
+	switch {
+	case c.zw != nil:
+		if _, err := c.zw.Write(p); err != nil {
+			return err
+		}
+		if f, ok := c.zw.(interface{ Flush() error }); ok && c.streaming {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+			return c.bw.Flush()
+		}
+		return nil
+	case c.chunked:
+		_, err := c.out.WriteChunkedBody(p)
+		return err
+	default:
+		_, err := c.out.WriteBody(p)
+		return err
+	}
+}
+
+func (c *compressWriter) WriteTrailers(h response.Headers) error {
+	if err := c.closeCompressor(); err != nil {
+		return err
+	}
+	c.ended = true
+	return c.out.WriteTrailers(h)
+}
+
+// finish ends the body once the handler returns. An incomplete body is
+// left unterminated so the connection is not reused for a short response
+func (c *compressWriter) finish(complete bool) {
+	if c.ended || !complete || !c.chunked {
+		return
+	}
+	if err := c.closeCompressor(); err != nil {
+		return
+	}
+	_, _ = c.out.WriteChunkedBodyDone()
+}
+
+// closeCompressor ends the compressed stream and sends what is still
+// buffered
+func (c *compressWriter) closeCompressor() error {
+	if c.zw == nil {
+		return nil
+	}
+	if err := c.zw.Close(); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// chunkWriter sends compressed output as body chunks
+type chunkWriter struct {
+	w *response.Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.WriteChunkedBody(p)
+}
+
+func addVary(h response.Headers) {
+	if h.HasToken("Vary", "Accept-Encoding") || h.HasToken("Vary", "*") {
+		return
+	}
+	if v := h.Get("Vary"); v != "" {
+		h.Set("Vary", v+", Accept-Encoding")
+		return
+	}
+	h.Set("Vary", "Accept-Encoding")
+}
+
+// negotiate picks the coding with the highest q-value in accept, breaking
+// ties by the order of encodings. It returns nil when none is acceptable
+func negotiate(accept string, encodings []Encoding) *Encoding {
+	if accept == "" {
+		return nil
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		weights[name] = q
+	}
+
+	var best *Encoding
+	bestQ := 0.0
+	for i := range encodings {
+		q, ok := weights[encodings[i].Name]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = &encodings[i], q
+		}
+	}
+	return best
+}
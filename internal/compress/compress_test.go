@@ -0,0 +1,250 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var page = []byte(strings.Repeat("<p>compress me</p>\n", 200))
+
+func fixedHandler(contentType string, body []byte) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Content-Type", contentType)
+		h.Set("ETag", `"v1"`)
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteBody(body)
+	}
+}
+
+// run serves one request through the middleware and parses what came out
+func run(t *testing.T, h server.Handler, opts Options, raw string) (*http.Response, []byte, *response.Writer) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	New(opts)(h)(w, req)
+
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body, w
+}
+
+func get(acceptEncoding string) string {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if acceptEncoding != "" {
+		raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+	}
+	return raw + "\r\n"
+}
+
+func TestCompression(t *testing.T) {
+	h := fixedHandler("text/html; charset=utf-8", page)
+
+	// Test: gzip is preferred and the response switches to chunked
+	resp, body, w := run(t, h, Options{}, get("deflate, gzip"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+	assert.True(t, w.Reusable())
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, plain)
+	assert.Less(t, len(body), len(page))
+
+	// Test: q-values override server preference
+	resp, body, _ = run(t, h, Options{}, get("gzip;q=0.5, deflate"))
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	zr2, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err = io.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, page, plain)
+
+	// Test: Nothing acceptable leaves the body alone but still varies
+	for _, accept := range []string{"", "br", "gzip;q=0, deflate;q=0", "identity, *;q=0"} {
+		resp, body, _ = run(t, h, Options{}, get(accept))
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), accept)
+		assert.Equal(t, strconv.Itoa(len(page)), resp.Header.Get("Content-Length"), accept)
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"), accept)
+		assert.Equal(t, page, body, accept)
+	}
+
+	// Test: Wildcard accepts the preferred coding
+	resp, _, _ = run(t, h, Options{}, get("*"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+}
+
+func TestCompressionSkips(t *testing.T) {
+	// Test: Already compressed types are left alone and do not vary
+	resp, body, _ := run(t, fixedHandler("image/png", page), Options{}, get("gzip"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+	assert.Equal(t, page, body)
+
+	resp, _, _ = run(t, fixedHandler("video/mp4", page), Options{}, get("gzip"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	// Test: Bodies under the size threshold
+	resp, body, _ = run(t, fixedHandler("text/plain", []byte("short")), Options{}, get("gzip"))
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "short", string(body))
+
+	// Test: A lower threshold compresses them
+	resp, _, _ = run(t, fixedHandler("text/plain", []byte("short")), Options{MinSize: 1}, get("gzip"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// Test: Existing Vary values are kept
+	resp, _, _ = run(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(page))
+		h.Set("Vary", "Origin")
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteBody(page)
+	}, Options{}, get("gzip"))
+	assert.Equal(t, "Origin, Accept-Encoding", resp.Header.Get("Vary"))
+
+	// Test: Absolute-form proxy requests pass through untouched
+	req, err := request.RequestFromReaderWithOptions(strings.NewReader(
+		"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nAccept-Encoding: gzip\r\n\r\n"),
+		request.Options{ProxyMode: true})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	New(Options{})(fixedHandler("text/html", page))(response.NewWriter(&out), req)
+	resp, err = http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+}
+
+func TestCompressionNilHeaders(t *testing.T) {
+	// Test: A handler that sends no headers at all does not panic
+	resp, body, _ := run(t, func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(nil)
+		_, _ = w.WriteChunkedBody(page)
+		_, _ = w.WriteChunkedBodyDone()
+	}, Options{}, get("gzip"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, plain)
+}
+
+func TestCompressionStreaming(t *testing.T) {
+	// Test: A chunked handler response is compressed and trailers survive
+	h := func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.Headers{
+			"content-type":      "text/plain",
+			"transfer-encoding": "chunked",
+			"trailer":           "x-checksum",
+		})
+		for i := 0; i < 3; i++ {
+			_, _ = w.WriteChunkedBody(page)
+		}
+		_ = w.WriteTrailers(response.Headers{"x-checksum": "abc"})
+	}
+	resp, body, w := run(t, h, Options{}, get("gzip"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	assert.True(t, w.Reusable())
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat(page, 3), plain)
+
+	// Test: An unfinished handler body is not terminated for it
+	var out bytes.Buffer
+	req, err := request.RequestFromReader(strings.NewReader(get("gzip")))
+	require.NoError(t, err)
+	w = response.NewWriter(&out)
+	New(Options{})(func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(page)))
+		_, _ = w.WriteBody(page[:10])
+	})(w, req)
+	assert.False(t, w.Reusable())
+	assert.False(t, strings.HasSuffix(out.String(), "0\r\n\r\n"))
+}
+
+func TestCompressionChunking(t *testing.T) {
+	body := make([]byte, 64*1024)
+	_, err := rand.New(rand.NewSource(1)).Read(body)
+	require.NoError(t, err)
+	req, err := request.RequestFromReader(strings.NewReader(get("gzip")))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	New(Options{})(fixedHandler("text/plain", body))(response.NewWriter(&out), req)
+
+	// Test: The compressor's small writes are gathered into full chunks
+	// rather than each getting its own
+	br := bufio.NewReader(&out)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	var sizes []int64
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		sizes = append(sizes, size)
+		_, err = br.Discard(int(size) + 2)
+		require.NoError(t, err)
+	}
+	require.NotEmpty(t, sizes)
+	for _, size := range sizes[:len(sizes)-1] {
+		assert.GreaterOrEqual(t, size, int64(4096))
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	encodings := Options{}.withDefaults().Encodings
+	name := func(accept string) string {
+		if e := negotiate(accept, encodings); e != nil {
+			return e.Name
+		}
+		return ""
+	}
+	assert.Equal(t, "gzip", name("gzip, deflate"))
+	assert.Equal(t, "gzip", name("GZIP"))
+	assert.Equal(t, "deflate", name("deflate;q=1.0, gzip;q=0.9"))
+	assert.Equal(t, "deflate", name("*;q=0.1, deflate;q=0.2"))
+	assert.Equal(t, "", name("gzip;q=bogus"))
+	assert.Equal(t, "", name("identity"))
+}
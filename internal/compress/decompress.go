@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+var ErrBodyTooLarge = errors.New("decompressed body exceeds the size limit")
+
+// Decoder wraps r so that reading from it yields the decoded body
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+// DefaultDecoders handle the codings HTTP defines for compression
+var DefaultDecoders = map[string]Decoder{
+	"gzip":   gzipDecoder,
+	"x-gzip": gzipDecoder,
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		// Deflate is meant to be zlib-wrapped, but some clients send a
+		// raw deflate stream. Peek at the zlib header to tell them apart
+		br := bufio.NewReader(r)
+		head, err := br.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if (uint16(head[0])<<8|uint16(head[1]))%31 == 0 && head[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+}
+
+func gzipDecoder(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type DecompressOptions struct {
+	// Decoders by coding name. Nil means DefaultDecoders
+	Decoders map[string]Decoder
+	// MaxSize caps the decoded body. Zero means 10MiB
+	MaxSize int64
+}
+
+func (o DecompressOptions) withDefaults() DecompressOptions {
+	if o.Decoders == nil {
+		o.Decoders = DefaultDecoders
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = 10 << 20
+	}
+	return o
+}
+
+// Decompress returns middleware that decodes request bodies sent with a
+// Content-Encoding, so handlers always see the plain bytes. Unknown codings
+// get 415 and bodies that decode past MaxSize get 413
+func Decompress(opts DecompressOptions) server.Middleware {
+	opts = opts.withDefaults()
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			codings := parseCodings(req.Headers.Get("Content-Encoding"))
+			if len(codings) == 0 {
+				next(w, req)
+				return
+			}
+
+			for _, c := range codings {
+				if _, ok := opts.Decoders[c]; !ok {
+					// RFC 9110 15.5.16: say which codings would work
+					_ = w.WriteError(response.StatusUnsupportedMediaType, response.Headers{
+						"accept-encoding": supported(opts.Decoders),
+					})
+					return
+				}
+			}
+
+			body, err := decode(req.Body, codings, opts)
+			switch {
+			case errors.Is(err, ErrBodyTooLarge):
+				_ = w.WriteError(response.StatusContentTooLarge, nil)
+				return
+			case err != nil:
+				_ = w.WriteError(response.StatusBadRequest, nil)
+				return
+			}
+
+			req.Body = body
+			delete(req.Headers, "content-encoding")
+			if _, ok := req.Headers["content-length"]; ok {
+				req.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			next(w, req)
+		}
+	}
+}
+
+// parseCodings lists the codings in the order they were applied, leaving
+// out identity
+func parseCodings(v string) []string {
+	var codings []string
+	for _, c := range strings.Split(v, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	return codings
+}
+
+// decode undoes codings from the last applied to the first, stopping as
+// soon as the output passes MaxSize
+func decode(body []byte, codings []string, opts DecompressOptions) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		rc, err := opts.Decoders[codings[i]](r)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, opts.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > opts.MaxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return out, nil
+}
+
+func supported(decoders map[string]Decoder) string {
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
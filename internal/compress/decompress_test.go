@@ -0,0 +1,109 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compressWith(t *testing.T, newWriter func(io.Writer) io.WriteCloser, p []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := newWriter(&buf)
+	_, err := zw.Write(p)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, p []byte) []byte {
+	return compressWith(t, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }, p)
+}
+
+// post serves a POST carrying body with the given Content-Encoding and
+// returns what the handler saw plus the raw response
+func post(t *testing.T, opts DecompressOptions, encoding string, body []byte) (*request.Request, string) {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\nHost: localhost\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var seen *request.Request
+	var out bytes.Buffer
+	Decompress(opts)(func(w *response.Writer, req *request.Request) {
+		seen = req
+		_ = w.WriteError(response.StatusOK, nil)
+	})(response.NewWriter(&out), req)
+	return seen, out.String()
+}
+
+func TestDecompress(t *testing.T) {
+	plain := []byte(strings.Repeat("field=value&", 100))
+
+	// Test: gzip body is replaced by the plain bytes
+	seen, _ := post(t, DecompressOptions{}, "gzip", gzipped(t, plain))
+	require.NotNil(t, seen)
+	assert.Equal(t, plain, seen.Body)
+	assert.Empty(t, seen.Headers.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(plain)), seen.Headers.Get("Content-Length"))
+
+	// Test: deflate as zlib and as a raw stream
+	zlibbed := compressWith(t, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }, plain)
+	seen, _ = post(t, DecompressOptions{}, "deflate", zlibbed)
+	require.NotNil(t, seen)
+	assert.Equal(t, plain, seen.Body)
+	raw := compressWith(t, func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}, plain)
+	seen, _ = post(t, DecompressOptions{}, "deflate", raw)
+	require.NotNil(t, seen)
+	assert.Equal(t, plain, seen.Body)
+
+	// Test: Stacked codings are undone last first
+	seen, _ = post(t, DecompressOptions{}, "deflate, gzip", gzipped(t, zlibbed))
+	require.NotNil(t, seen)
+	assert.Equal(t, plain, seen.Body)
+
+	// Test: identity is a no-op
+	seen, _ = post(t, DecompressOptions{}, "identity", plain)
+	require.NotNil(t, seen)
+	assert.Equal(t, plain, seen.Body)
+}
+
+func TestDecompressRejects(t *testing.T) {
+	// Test: Unknown coding is 415 with the supported list
+	seen, out := post(t, DecompressOptions{}, "br", []byte("whatever"))
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"), out)
+	assert.Contains(t, out, "accept-encoding: deflate, gzip, x-gzip\r\n")
+
+	// Test: A small bomb that expands past the cap is 413
+	bomb := gzipped(t, make([]byte, 1<<20))
+	require.Less(t, len(bomb), 4096)
+	seen, out = post(t, DecompressOptions{MaxSize: 64 << 10}, "gzip", bomb)
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"), out)
+
+	// Test: Corrupt data is 400
+	seen, out = post(t, DecompressOptions{}, "gzip", []byte("not gzip at all"))
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Truncated data is 400
+	seen, out = post(t, DecompressOptions{}, "gzip", gzipped(t, []byte("hello world"))[:15])
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+}
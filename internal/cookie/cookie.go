@@ -0,0 +1,238 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+)
+
+var (
+	ErrInvalidName  = errors.New("cookie name is not a token")
+	ErrInvalidValue = errors.New("cookie value has characters that cannot be sent")
+	ErrInvalidAttr  = errors.New("cookie attribute has characters that cannot be sent")
+	ErrInsecure     = errors.New("cookie needs the Secure attribute")
+	ErrHostPrefix   = errors.New("__Host- cookie must have Path=/ and no Domain")
+	ErrNotFound     = errors.New("cookie not present")
+	ErrAttrTooLong  = errors.New("cookie attribute exceeds 1024 bytes")
+)
+
+const (
+	// TimeFormat is the IMF-fixdate format used by Expires
+	TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+	// maxAttributeSize is the limit browsers apply (RFC 6265bis 5.6)
+	maxAttributeSize = 1024
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out, so the browser default
+	// applies
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+// Cookie is a single cookie. Parse only fills Name and Value; the rest are
+// attributes for Set-Cookie (RFC 6265 4.1)
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge is in seconds. Zero leaves it out and a negative value sends
+	// Max-Age=0, which deletes the cookie
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse splits a Cookie header into its name/value pairs, in order.
+// Malformed pairs are skipped rather than failing the whole header
+func Parse(header string) []Cookie {
+	var cookies []Cookie
+	for _, pair := range strings.Split(header, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !headers.IsToken([]byte(name)) {
+			continue
+		}
+		value = unquote(value)
+		if !validValue(value) {
+			continue
+		}
+		cookies = append(cookies, Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// FromRequest returns the cookies the client sent
+func FromRequest(req *request.Request) []Cookie {
+	return Parse(req.Headers.Get("Cookie"))
+}
+
+// Get returns the first cookie called name
+func Get(req *request.Request, name string) (Cookie, error) {
+	for _, c := range FromRequest(req) {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Cookie{}, ErrNotFound
+}
+
+// Set adds c to h as its own Set-Cookie line
+func Set(h headers.Headers, c Cookie) error {
+	v, err := c.Encode()
+	if err != nil {
+		return err
+	}
+	h.Add("Set-Cookie", v)
+	return nil
+}
+
+// Delete adds a Set-Cookie line that expires the cookie called name. Path
+// and Domain must match the ones it was set with
+func Delete(h headers.Headers, name, path, domain string) error {
+	return Set(h, Cookie{
+		Name:    name,
+		Path:    path,
+		Domain:  domain,
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+}
+
+// Encode returns the Set-Cookie value for c after checking it
+func (c Cookie) Encode() (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	// Browsers accept spaces and commas in values, but only when quoted
+	if strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(TimeFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=")
+		b.WriteString(c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String(), nil
+}
+
+// Validate checks that c can be sent and that browsers will accept it:
+// SameSite=None, Partitioned and the __Secure- and __Host- prefixes all
+// require Secure
+func (c Cookie) Validate() error {
+	if !headers.IsToken([]byte(c.Name)) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if !validValue(c.Value) {
+		return fmt.Errorf("%w: %q", ErrInvalidValue, c.Name)
+	}
+	for _, attr := range []string{c.Path, c.Domain} {
+		if len(attr) > maxAttributeSize {
+			return ErrAttrTooLong
+		}
+		if !validAttr(attr) {
+			return fmt.Errorf("%w: %q", ErrInvalidAttr, attr)
+		}
+	}
+
+	needsSecure := c.SameSite == SameSiteNone || c.Partitioned ||
+		strings.HasPrefix(c.Name, "__Secure-") || strings.HasPrefix(c.Name, "__Host-")
+	if needsSecure && !c.Secure {
+		return fmt.Errorf("%w: %q", ErrInsecure, c.Name)
+	}
+	if strings.HasPrefix(c.Name, "__Host-") && (c.Path != "/" || c.Domain != "") {
+		return ErrHostPrefix
+	}
+	return nil
+}
+
+// validValue allows cookie-octets (RFC 6265 4.1.1) plus the space and comma
+// that Encode quotes
+func validValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == ' ' || c == ',' {
+			continue
+		}
+		if c < 0x21 || c > 0x7e || c == '"' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// validAttr rejects anything that would end the attribute early
+func validAttr(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c == 0x7f || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
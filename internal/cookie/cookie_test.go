@@ -0,0 +1,121 @@
+package cookie
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Pairs in order, quotes stripped, junk skipped
+	cookies := Parse(`session=abc123; theme="dark"; bad name=x; novalue; empty=; a=1; a=2`)
+	assert.Equal(t, []Cookie{
+		{Name: "session", Value: "abc123"},
+		{Name: "theme", Value: "dark"},
+		{Name: "empty", Value: ""},
+		{Name: "a", Value: "1"},
+		{Name: "a", Value: "2"},
+	}, cookies)
+	assert.Empty(t, Parse(""))
+
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nCookie: a=1; b=2\r\n\r\n"))
+	require.NoError(t, err)
+	c, err := Get(req, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "2", c.Value)
+	_, err = Get(req, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEncode(t *testing.T) {
+	expires := time.Date(2030, time.March, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	cases := []struct {
+		cookie Cookie
+		want   string
+	}{
+		{Cookie{Name: "id", Value: "42"}, "id=42"},
+		{
+			Cookie{
+				Name: "session", Value: "abc", Path: "/", Domain: ".example.com",
+				Expires: expires, MaxAge: 3600, Secure: true, HttpOnly: true,
+				SameSite: SameSiteStrict, Partitioned: true,
+			},
+			"session=abc; Path=/; Domain=example.com; Expires=Mon, 04 Mar 2030 04:06:07 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=Strict; Partitioned",
+		},
+		{Cookie{Name: "gone", MaxAge: -1}, "gone=; Max-Age=0"},
+		{Cookie{Name: "msg", Value: "hello, world"}, `msg="hello, world"`},
+		{Cookie{Name: "x", Value: "1", SameSite: SameSiteLax}, "x=1; SameSite=Lax"},
+		{Cookie{Name: "__Host-id", Value: "1", Path: "/", Secure: true}, "__Host-id=1; Path=/; Secure"},
+	}
+	for _, tc := range cases {
+		got, err := tc.cookie.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		cookie Cookie
+		err    error
+	}{
+		{Cookie{Name: "bad name", Value: "1"}, ErrInvalidName},
+		{Cookie{Name: "", Value: "1"}, ErrInvalidName},
+		{Cookie{Name: "x", Value: "a;b"}, ErrInvalidValue},
+		{Cookie{Name: "x", Value: `a"b`}, ErrInvalidValue},
+		{Cookie{Name: "x", Value: "é"}, ErrInvalidValue},
+		{Cookie{Name: "x", Value: "1", Path: "/; Domain=evil.com"}, ErrInvalidAttr},
+		{Cookie{Name: "x", Value: "1", Domain: "a\r\nb"}, ErrInvalidAttr},
+		{Cookie{Name: "x", Value: "1", Path: "/" + strings.Repeat("a", 1024)}, ErrAttrTooLong},
+		{Cookie{Name: "x", Value: "1", SameSite: SameSiteNone}, ErrInsecure},
+		{Cookie{Name: "x", Value: "1", Partitioned: true}, ErrInsecure},
+		{Cookie{Name: "__Secure-x", Value: "1"}, ErrInsecure},
+		{Cookie{Name: "__Host-x", Value: "1", Secure: true, Path: "/app"}, ErrHostPrefix},
+		{Cookie{Name: "__Host-x", Value: "1", Secure: true, Path: "/", Domain: "example.com"}, ErrHostPrefix},
+	}
+	for _, tc := range cases {
+		_, err := tc.cookie.Encode()
+		require.ErrorIs(t, err, tc.err, "%+v", tc.cookie)
+	}
+}
+
+func TestSetWritesSeparateLines(t *testing.T) {
+	h := response.GetDefaultHeaders(0)
+	require.NoError(t, Set(h, Cookie{Name: "a", Value: "1", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}))
+	require.NoError(t, Set(h, Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.NoError(t, Delete(h, "c", "/", ""))
+	require.Error(t, Set(h, Cookie{Name: "bad name"}))
+	assert.Len(t, h.Values("Set-Cookie"), 3)
+
+	// Test: Each cookie is its own line, so the comma in Expires cannot be
+	// mistaken for a list separator
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(response.StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Contains(t, out.String(), "\r\nset-cookie: a=1; Expires=Tue, 01 Jan 2030 00:00:00 GMT\r\n")
+	assert.Contains(t, out.String(), "\r\nset-cookie: b=2; HttpOnly\r\n")
+	assert.Contains(t, out.String(), "\r\nset-cookie: c=; Path=/; Expires=Thu, 01 Jan 1970 00:00:00 GMT; Max-Age=0\r\n")
+	assert.NotContains(t, out.String(), "\n\n")
+
+	// Test: Repeated Set-Cookie lines survive a parse
+	parsed := headers.Headers{}
+	raw := "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\nVary: Origin\r\nVary: Cookie\r\n\r\n"
+	for n := 0; ; {
+		consumed, done, err := parsed.Parse([]byte(raw[n:]))
+		require.NoError(t, err)
+		n += consumed
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a=1", "b=2"}, parsed.Values("set-cookie"))
+	assert.Equal(t, "Origin, Cookie", parsed.Get("Vary"))
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
@@ -12,14 +11,64 @@ type Headers map[string]string
 
 var (
 	ErrMalformedHeader = errors.New("malformed Header")
+	ErrObsFold         = errors.New("obsolete line folding is not supported")
+	ErrInvalidValue    = errors.New("invalid character in header value")
 )
 
-var headerRegex = regexp.MustCompile(`^[ \t]*([a-zA-Z0-9!#$%&'*+\-.^_` + "`" + `|~]+):[ \t]*(.*?)[ \t]*$`)
+var crlf = []byte("\r\n")
+
+// tokenTable marks the tchar bytes from RFC 9110 section 5.6.2
+var tokenTable = func() [256]bool {
+	var t [256]bool
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		t[c] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		t[c] = true
+	}
+	return t
+}()
+
+// commonNames interns the lowercase form of frequently seen field names so
+// parsing them does not allocate a fresh key string per request
+var commonNames = func() map[string]string {
+	names := []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-encoding", "content-length",
+		"content-type", "cookie", "host", "origin", "referer", "te",
+		"trailer", "transfer-encoding", "upgrade", "user-agent",
+		"x-forwarded-for", "x-request-id",
+	}
+	m := make(map[string]string, len(names))
+	for _, n := range names {
+		m[n] = n
+	}
+	return m
+}()
+
+// IsToken reports whether b is a non-empty sequence of tchars
+func IsToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !tokenTable[c] {
+			return false
+		}
+	}
+	return true
+}
 
 func (h *Headers) Parse(data []byte) (int, bool, error) {
 
 	// 1. Find the next CRLF
-	lineEnd := bytes.Index(data, []byte("\r\n"))
+	lineEnd := bytes.Index(data, crlf)
 
 	// If no CRLF is found, we don't have a full line yet
 	if lineEnd == -1 {
@@ -31,32 +80,82 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 		return 2, true, nil
 	}
 
-	// Calculate actual position in the original data slice
-
 	line := data[:lineEnd]
 
+	// 2. A line starting with whitespace is either obs-fold or junk between
+	// the start line and the first field. Both are rejected (RFC 9112 5.2)
+	if line[0] == ' ' || line[0] == '\t' {
+		return 0, false, ErrObsFold
+	}
+
 	// 3. Process the header line
-	key, value, err := parseSingleHeader(string(line))
+	key, value, err := parseFieldLine(line)
 	if err != nil {
 		return 0, false, err
 	}
 
-	existingValue, exists := (*h)[key]
+	h.Add(key, value)
 
-	if exists {
-		(*h)[key] = existingValue + ", " + value
-	} else {
-		(*h)[key] = value
+	return lineEnd + 2, false, nil
+
+}
+
+// separateLines lists fields that cannot be combined into one
+// comma-separated line (RFC 9110 5.3). Their values are kept newline
+// separated instead, which never clashes with a real value since field
+// values may not contain control characters
+var separateLines = map[string]bool{
+	"set-cookie": true,
+}
+
+// Add appends value to any existing value of key. Set-Cookie values are
+// kept apart so each one is written on its own line; see Values
+func (h Headers) Add(key, value string) {
+	if h == nil {
+		return
 	}
+	key = strings.ToLower(key)
+	existing, ok := h[key]
+	switch {
+	case !ok:
+		h[key] = value
+	case separateLines[key]:
+		h[key] = existing + "\n" + value
+	default:
+		h[key] = existing + ", " + value
+	}
+}
 
-	return lineEnd + 2, false, nil
+// Values returns the separate field lines stored for key
+func (h Headers) Values(key string) []string {
+	v, ok := h[strings.ToLower(key)]
+	if !ok {
+		return nil
+	}
+	return Lines(v)
+}
 
+// Lines splits a stored value into the field lines it should be written as.
+// Only fields added through Add more than once hold more than one
+func Lines(value string) []string {
+	return strings.Split(value, "\n")
 }
 
 func (h *Headers) Get(key string) string {
 	return (*h)[strings.ToLower(key)]
 }
 
+// HasToken reports whether the comma-separated list in key contains token,
+// compared case-insensitively. Used for Connection, Upgrade and friends
+func (h Headers) HasToken(key, token string) bool {
+	for _, v := range strings.Split(h[strings.ToLower(key)], ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h Headers) Set(key, value string) {
 	if h == nil {
 		return
@@ -79,15 +178,60 @@ func (h Headers) String() string {
 	return b.String()
 }
 
-func parseSingleHeader(line string) (string, string, error) {
-	rawLine := strings.TrimSpace(line)
-	if !headerRegex.MatchString(rawLine) {
-		fmt.Println(rawLine)
-		return "", "", fmt.Errorf("%v:, got %s", ErrMalformedHeader, rawLine)
+func parseFieldLine(line []byte) (string, string, error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon == -1 {
+		return "", "", fmt.Errorf("%w: got %q", ErrMalformedHeader, line)
 	}
 
-	parts := strings.SplitN(rawLine, ":", 2)
+	// The name must be a bare token, which also rules out whitespace
+	// before the colon
+	name := line[:colon]
+	if !IsToken(name) {
+		return "", "", fmt.Errorf("%w: got %q", ErrMalformedHeader, line)
+	}
 
-	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1]), nil
+	value := trimOWS(line[colon+1:])
+
+	// CR, LF, NUL and other controls in a value are a classic smuggling
+	// vector, so they are rejected outright (RFC 9110 5.5)
+	for _, c := range value {
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return "", "", fmt.Errorf("%w: 0x%02x", ErrInvalidValue, c)
+		}
+	}
 
+	return lowerName(name), string(value), nil
+}
+
+// lowerName lowercases a field name, reusing an interned string when the
+// name is a common one
+func lowerName(name []byte) string {
+	var buf [32]byte
+	if len(name) > len(buf) {
+		return strings.ToLower(string(name))
+	}
+
+	lower := buf[:len(name)]
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	if interned, ok := commonNames[string(lower)]; ok {
+		return interned
+	}
+	return string(lower)
+}
+
+// trimOWS strips the optional whitespace (SP / HTAB) around a field value
+func trimOWS(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
+		b = b[:len(b)-1]
+	}
+	return b
 }
@@ -56,3 +56,61 @@ func TestHeadersMultipleValues(t *testing.T) {
 	expectedValue := "lane-loves-go, prime-loves-zig"
 	assert.Equal(t, expectedValue, headers["set-person"])
 }
+
+func TestHeadersAddKeepsSetCookieApart(t *testing.T) {
+	h := Headers{}
+	h.Add("Set-Cookie", "a=1; Expires=Tue, 01 Jan 2030 00:00:00 GMT")
+	h.Add("set-cookie", "b=2")
+	h.Add("Cache-Control", "no-store")
+	h.Add("Cache-Control", "private")
+
+	// Test: Set-Cookie values stay separate lines, list fields are joined
+	assert.Equal(t, []string{"a=1; Expires=Tue, 01 Jan 2030 00:00:00 GMT", "b=2"}, h.Values("Set-Cookie"))
+	assert.Equal(t, []string{"no-store, private"}, h.Values("Cache-Control"))
+	assert.Nil(t, h.Values("Missing"))
+}
+
+func TestHeadersRejectsAmbiguousLines(t *testing.T) {
+	// Test: obs-fold continuation line
+	headers := Headers{}
+	_, _, err := headers.Parse([]byte(" folded: value\r\n\r\n"))
+	require.ErrorIs(t, err, ErrObsFold)
+
+	// Test: bare CR inside a value
+	headers = Headers{}
+	_, _, err = headers.Parse([]byte("X-Foo: a\rb\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidValue)
+
+	// Test: tab inside a value is allowed
+	headers = Headers{}
+	_, _, err = headers.Parse([]byte("X-Foo: a\tb\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\tb", headers["x-foo"])
+}
+
+var benchHeaderLines = [][]byte{
+	[]byte("Host: localhost:42069\r\n"),
+	[]byte("User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0\r\n"),
+	[]byte("Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n"),
+	[]byte("Accept-Encoding: gzip, deflate, br\r\n"),
+	[]byte("Content-Type: application/json\r\n"),
+	[]byte("X-Request-Id: 7f1c9a3e-4b2d-4e8f-9c6a-2d1e0f3b5a7c\r\n"),
+}
+
+func BenchmarkHeadersParse(b *testing.B) {
+	var total int
+	for _, line := range benchHeaderLines {
+		total += len(line)
+	}
+	b.SetBytes(int64(total))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		h := make(Headers, len(benchHeaderLines))
+		for _, line := range benchHeaderLines {
+			if _, _, err := h.Parse(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface opens every HTTP/2 connection (RFC 9113 3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+const (
+	FlagEndStream  uint8 = 0x1
+	FlagAck        uint8 = 0x1
+	FlagEndHeaders uint8 = 0x4
+	FlagPadded     uint8 = 0x8
+	FlagPriority   uint8 = 0x20
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// ErrCode is carried by RST_STREAM and GOAWAY (RFC 9113 7)
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+const (
+	frameHeaderLen = 9
+	// defaultMaxFrameSize is the initial SETTINGS_MAX_FRAME_SIZE
+	defaultMaxFrameSize = 16384
+	maxAllowedFrameSize = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+// ConnError ends the whole connection with a GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError resets a single stream
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.StreamID, e.Code)
+}
+
+type Frame struct {
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f Frame) Has(flag uint8) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads one frame, refusing payloads above maxSize
+func ReadFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Frame{}, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := Frame{
+		Type:     FrameType(head[3]),
+		Flags:    head[4],
+		StreamID: binary.BigEndian.Uint32(head[5:]) & 0x7fffffff,
+	}
+	if length > maxSize {
+		return f, ConnError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes", length)}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// AppendFrame encodes a frame onto dst
+func AppendFrame(dst []byte, f Frame) []byte {
+	n := len(f.Payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(f.Type), f.Flags)
+	dst = binary.BigEndian.AppendUint32(dst, f.StreamID&0x7fffffff)
+	return append(dst, f.Payload...)
+}
+
+// stripPadding removes the pad length byte and trailing padding
+func stripPadding(f Frame) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, ConnError{ErrCodeProtocol, "padded frame without pad length"}
+	}
+	pad := int(f.Payload[0])
+	if pad >= len(f.Payload) {
+		return nil, ConnError{ErrCodeProtocol, "padding exceeds payload"}
+	}
+	return f.Payload[1 : len(f.Payload)-pad], nil
+}
+
+// Setting is a single SETTINGS parameter
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnError{ErrCodeFrameSize, "SETTINGS length not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		s := Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		}
+		switch s.ID {
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return nil, ConnError{ErrCodeProtocol, "ENABLE_PUSH must be 0 or 1"}
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return nil, ConnError{ErrCodeFlowControl, "INITIAL_WINDOW_SIZE too large"}
+			}
+		case SettingMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxAllowedFrameSize {
+				return nil, ConnError{ErrCodeProtocol, "MAX_FRAME_SIZE out of range"}
+			}
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings []Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
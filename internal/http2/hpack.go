@@ -0,0 +1,351 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrHpackDecode       = errors.New("hpack: malformed header block")
+	ErrHeaderListTooLong = errors.New("hpack: header list exceeds size limit")
+)
+
+// HeaderField is one decoded name/value pair
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// size is the entry size used for table accounting (RFC 7541 4.1)
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// staticTable is RFC 7541 Appendix A. Index 1 is staticTable[0]
+var staticTable = []HeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// dynamicTable is the FIFO of RFC 7541 2.3.2. Newest entries are at the end
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// Decoder decodes header blocks for one direction of a connection
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit we advertised; updates may not exceed it
+	maxTableSize int
+	// MaxHeaderListSize caps the decoded size of one block. Zero disables it
+	MaxHeaderListSize int
+}
+
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+func (d *Decoder) lookup(i uint64) (HeaderField, error) {
+	switch {
+	case i == 0:
+		return HeaderField{}, fmt.Errorf("%w: index 0", ErrHpackDecode)
+	case i <= uint64(len(staticTable)):
+		return staticTable[i-1], nil
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(d.table.entries)) {
+		return HeaderField{}, fmt.Errorf("%w: index out of range", ErrHpackDecode)
+	}
+	return d.table.entries[len(d.table.entries)-int(i)], nil
+}
+
+// Decode decodes a complete header block. A block over MaxHeaderListSize
+// is still decoded to the end, so the dynamic table stays in sync with the
+// encoder, before ErrHeaderListTooLong is returned
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	listSize := 0
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   HeaderField
+			err error
+		)
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field
+			var idx uint64
+			if idx, block, err = readInt(block, 7); err != nil {
+				return nil, err
+			}
+			if f, err = d.lookup(idx); err != nil {
+				return nil, err
+			}
+
+		case b&0xE0 == 0x20:
+			// Dynamic table size update, only allowed before any field
+			if sawField {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrHpackDecode)
+			}
+			var size uint64
+			if size, block, err = readInt(block, 5); err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: table size %d over limit", ErrHpackDecode, size)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+
+		default:
+			// Literal: with incremental indexing (01), without indexing
+			// (0000) or never indexed (0001)
+			prefix := uint8(4)
+			indexed := b&0xC0 == 0x40
+			if indexed {
+				prefix = 6
+			}
+			if f, block, err = d.readLiteral(block, prefix); err != nil {
+				return nil, err
+			}
+			if indexed {
+				d.table.add(f)
+			}
+		}
+
+		sawField = true
+		listSize += f.size()
+		// Past the cap the rest of the block is still decoded, so its
+		// table inserts keep us in step with the encoder, but nothing
+		// more is kept
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			fields = nil
+			continue
+		}
+		fields = append(fields, f)
+	}
+	if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+		return nil, ErrHeaderListTooLong
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	idx, block, err := readInt(block, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx > 0 {
+		named, err := d.lookup(idx)
+		if err != nil {
+			return f, nil, err
+		}
+		f.Name = named.Name
+	} else if f.Name, block, err = readString(block); err != nil {
+		return f, nil, err
+	}
+	if f.Value, block, err = readString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+// readInt decodes an N-bit prefix integer (RFC 7541 5.1)
+func readInt(b []byte, n uint8) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrHpackDecode)
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	b = b[1:]
+	if v < max {
+		return v, b, nil
+	}
+
+	var shift uint
+	for len(b) > 0 {
+		c := b[0]
+		b = b[1:]
+		v += uint64(c&0x7F) << shift
+		if c&0x80 == 0 {
+			return v, b, nil
+		}
+		shift += 7
+		// Nothing legitimate needs more than a few continuation bytes
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrHpackDecode)
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", ErrHpackDecode)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrHpackDecode)
+	}
+	huffman := b[0]&0x80 != 0
+	n, b, err := readInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(b)) < n {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrHpackDecode)
+	}
+	raw, b := b[:n], b[n:]
+	if !huffman {
+		return string(raw), b, nil
+	}
+	decoded, err := huffmanDecode(nil, raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), b, nil
+}
+
+// Encoder produces header blocks. It never inserts into the dynamic table,
+// which keeps it stateless: a field is either an exact static match or a
+// literal without indexing
+type Encoder struct{}
+
+func (Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		nameIdx := 0
+		exact := false
+		for i, s := range staticTable {
+			if s.Name != f.Name {
+				continue
+			}
+			if nameIdx == 0 {
+				nameIdx = i + 1
+			}
+			if s.Value == f.Value {
+				nameIdx, exact = i+1, true
+				break
+			}
+		}
+
+		if exact {
+			dst = appendInt(dst, 7, 0x80, uint64(nameIdx))
+			continue
+		}
+		dst = appendInt(dst, 4, 0x00, uint64(nameIdx))
+		if nameIdx == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
+
+func appendInt(dst []byte, n uint8, flags byte, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if h := huffmanEncodedLen(s); h < len(s) {
+		dst = appendInt(dst, 7, 0x80, uint64(h))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,145 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestIntegerCoding(t *testing.T) {
+	// Test: Examples from RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 5, 0, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 5, 0, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 8, 0, 42))
+
+	v, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	// Test: Truncated and oversized integers are rejected
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	require.ErrorIs(t, err, ErrHpackDecode)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	require.ErrorIs(t, err, ErrHpackDecode)
+}
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "custom-value", "Mon, 21 Oct 2013 20:13:21 GMT", "\x00\xff~"} {
+		enc := huffmanEncode(nil, s)
+		assert.Len(t, enc, huffmanEncodedLen(s))
+		dec, err := huffmanDecode(nil, enc)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(dec))
+	}
+
+	// Test: Example from RFC 7541 C.4.1
+	assert.Equal(t, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), huffmanEncode(nil, "www.example.com"))
+
+	// Test: Padding that is too long or not all ones is rejected
+	_, err := huffmanDecode(nil, []byte{0xff, 0xff})
+	require.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = huffmanDecode(nil, []byte{0x00})
+	require.ErrorIs(t, err, ErrInvalidHuffman)
+}
+
+func TestDecodeRequests(t *testing.T) {
+	first := []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}}
+	second := append(first[:4:4], HeaderField{"cache-control", "no-cache"})
+	third := []HeaderField{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"}}
+
+	cases := []struct {
+		name   string
+		blocks []string
+	}{
+		{
+			// Test: RFC 7541 C.3, requests without Huffman coding
+			name: "plain",
+			blocks: []string{
+				"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+				"8286 84be 5808 6e6f 2d63 6163 6865",
+				"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+			},
+		},
+		{
+			// Test: RFC 7541 C.4, the same requests with Huffman coding
+			name: "huffman",
+			blocks: []string{
+				"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+				"8286 84be 5886 a8eb 1064 9cbf",
+				"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(4096)
+			for i, want := range [][]HeaderField{first, second, third} {
+				fields, err := d.Decode(unhex(t, tc.blocks[i]))
+				require.NoError(t, err)
+				assert.Equal(t, want, fields)
+			}
+			// The table ends up as in the RFC, newest entry last here
+			require.Len(t, d.table.entries, 3)
+			assert.Equal(t, HeaderField{"custom-key", "custom-value"}, d.table.entries[2])
+			assert.Equal(t, 164, d.table.size)
+		})
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	// Test: Table size update above the advertised limit
+	d := NewDecoder(4096)
+	_, err := d.Decode(appendInt(nil, 5, 0x20, 8192))
+	require.ErrorIs(t, err, ErrHpackDecode)
+
+	// Test: Index beyond both tables
+	_, err = NewDecoder(4096).Decode([]byte{0xff, 0x00})
+	require.ErrorIs(t, err, ErrHpackDecode)
+
+	// Test: Header list size cap
+	d = NewDecoder(4096)
+	d.MaxHeaderListSize = 40
+	block := Encoder{}.Encode(nil, []HeaderField{{"x-long", strings.Repeat("a", 20)}})
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLong)
+
+	// Test: Fields indexed after the cap still reach the dynamic table
+	d = NewDecoder(4096)
+	d.MaxHeaderListSize = 40
+	block = appendString(appendString(append(block, 0x40), "x-tag"), "tagged")
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLong)
+	d.MaxHeaderListSize = 0
+	fields, err := d.Decode([]byte{0x80 | byte(len(staticTable)+1)})
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{"x-tag", "tagged"}}, fields)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/plain"},
+		{"x-custom", "value"},
+	}
+	block := Encoder{}.Encode(nil, fields)
+	assert.Equal(t, byte(0x88), block[0])
+
+	d := NewDecoder(4096)
+	decoded, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+	assert.Empty(t, d.table.entries)
+}
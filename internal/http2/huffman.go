@@ -0,0 +1,94 @@
+package http2
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrInvalidHuffman = errors.New("hpack: invalid huffman-encoded data")
+
+// huffmanNode is a node of the decoding tree. Leaves have sym >= 0
+type huffmanNode struct {
+	children [2]int32
+	sym      int16
+}
+
+var (
+	huffmanTreeOnce sync.Once
+	huffmanTree     []huffmanNode
+)
+
+func buildHuffmanTree() {
+	huffmanTree = []huffmanNode{{children: [2]int32{-1, -1}, sym: -1}}
+	for sym, c := range huffmanTable {
+		n := int32(0)
+		for i := int(c.length) - 1; i >= 0; i-- {
+			bit := (c.code >> uint(i)) & 1
+			next := huffmanTree[n].children[bit]
+			if next == -1 {
+				huffmanTree = append(huffmanTree, huffmanNode{children: [2]int32{-1, -1}, sym: -1})
+				next = int32(len(huffmanTree) - 1)
+				huffmanTree[n].children[bit] = next
+			}
+			n = next
+		}
+		huffmanTree[n].sym = int16(sym)
+	}
+}
+
+// huffmanDecode decodes s, rejecting padding longer than 7 bits or not made
+// of ones as RFC 7541 5.2 requires. The EOS symbol has no leaf, so seeing
+// it also fails
+func huffmanDecode(dst, s []byte) ([]byte, error) {
+	huffmanTreeOnce.Do(buildHuffmanTree)
+
+	n := int32(0)
+	depth := 0
+	allOnes := true
+	for _, b := range s {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = huffmanTree[n].children[bit]
+			if n == -1 {
+				return nil, ErrInvalidHuffman
+			}
+			depth++
+			allOnes = allOnes && bit == 1
+			if sym := huffmanTree[n].sym; sym >= 0 {
+				dst = append(dst, byte(sym))
+				n, depth, allOnes = 0, 0, true
+			}
+		}
+	}
+	if depth > 7 || !allOnes {
+		return nil, ErrInvalidHuffman
+	}
+	return dst, nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanTable[s[i]].length)
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	var nbits uint
+	for i := 0; i < len(s); i++ {
+		c := huffmanTable[s[i]]
+		acc = acc<<c.length | uint64(c.code)
+		nbits += uint(c.length)
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(acc>>nbits))
+		}
+	}
+	if nbits > 0 {
+		// Pad with the high bits of EOS, which are all ones
+		dst = append(dst, byte(acc<<(8-nbits))|byte(0xff>>nbits))
+	}
+	return dst
+}
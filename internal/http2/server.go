@@ -0,0 +1,890 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var ErrBadPreface = errors.New("http2: client did not send the connection preface")
+
+// Handler has the same shape as server.Handler so the same function
+// serves both protocols
+type Handler func(w *response.Writer, req *request.Request)
+
+// NextProtoTLS is the ALPN protocol ID for HTTP/2 over TLS
+const NextProtoTLS = "h2"
+
+// Config holds the SETTINGS advertised on each connection plus a few local
+// limits. Server push is never used, so ENABLE_PUSH is always sent as 0
+type Config struct {
+	// MaxConcurrentStreams caps open streams per connection. Zero means 100
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize caps a decoded header block. Zero means 64KiB
+	MaxHeaderListSize uint32
+	// InitialWindowSize is the receive window of each stream. Zero keeps
+	// the protocol default of 65535
+	InitialWindowSize uint32
+	// MaxFrameSize is the largest frame payload we accept. Zero keeps the
+	// protocol default of 16384
+	MaxFrameSize uint32
+	// MaxBodySize caps a request body; larger ones are answered with 413.
+	// Zero means 10MiB
+	MaxBodySize int
+	// Shutdown starts a graceful close when it is closed: the connection
+	// sends GOAWAY, finishes the streams in flight and then hangs up
+	Shutdown <-chan struct{}
+	// Context is the parent of every stream's request context. Nil means
+	// context.Background
+	Context context.Context
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxConcurrentStreams == 0 {
+		c.MaxConcurrentStreams = 100
+	}
+	if c.MaxHeaderListSize == 0 {
+		c.MaxHeaderListSize = 64 * 1024
+	}
+	if c.InitialWindowSize == 0 {
+		c.InitialWindowSize = defaultWindowSize
+	}
+	if c.MaxFrameSize == 0 {
+		c.MaxFrameSize = defaultMaxFrameSize
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = 10 << 20
+	}
+	return c
+}
+
+// validate rejects settings the protocol does not allow
+func (c Config) validate() error {
+	if c.InitialWindowSize > maxWindowSize {
+		return fmt.Errorf("http2: initial window size %d too large", c.InitialWindowSize)
+	}
+	if c.MaxFrameSize < defaultMaxFrameSize || c.MaxFrameSize > maxAllowedFrameSize {
+		return fmt.Errorf("http2: max frame size %d out of range", c.MaxFrameSize)
+	}
+	return nil
+}
+
+// connectionSpecific headers are banned in HTTP/2 (RFC 9113 8.2.2)
+var connectionSpecific = map[string]struct{}{
+	"connection":        {},
+	"keep-alive":        {},
+	"proxy-connection":  {},
+	"transfer-encoding": {},
+	"upgrade":           {},
+}
+
+type serverConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler Handler
+	cfg     Config
+
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+
+	hdec *Decoder
+	henc Encoder
+
+	// mu guards everything below; cond wakes writers waiting on flow control
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	closed            bool
+	// draining is set once GOAWAY went out for a graceful shutdown
+	draining bool
+
+	// Read loop state. recvWindow is what the client may still send on
+	// the connection
+	sawSettings bool
+	continuing  *headerBlock
+	recvWindow  int64
+
+	handlers sync.WaitGroup
+	done     chan struct{}
+	// ctx is cancelled when the connection ends, taking every stream's
+	// request context with it
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// headerBlock collects a HEADERS frame and its CONTINUATIONs
+type headerBlock struct {
+	streamID  uint32
+	endStream bool
+	buf       []byte
+}
+
+func newServerConn(conn net.Conn, buffered []byte, handler Handler, cfg Config) *serverConn {
+	sc := &serverConn{
+		conn:              conn,
+		br:                bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		bw:                bufio.NewWriter(conn),
+		handler:           handler,
+		cfg:               cfg.withDefaults(),
+		hdec:              NewDecoder(4096),
+		streams:           make(map[uint32]*stream),
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		recvWindow:        defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		done:              make(chan struct{}),
+	}
+	sc.hdec.MaxHeaderListSize = int(sc.cfg.MaxHeaderListSize)
+	// writeSettings raises the connection window to match the streams'
+	sc.recvWindow = max(sc.recvWindow, int64(sc.cfg.InitialWindowSize))
+	sc.cond = sync.NewCond(&sc.mu)
+	parent := cfg.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	sc.ctx, sc.cancel = context.WithCancel(parent)
+	return sc
+}
+
+// ServeConn speaks HTTP/2 with prior knowledge on conn. buffered holds any
+// bytes already read off conn, normally the start of the client preface
+func ServeConn(conn net.Conn, buffered []byte, handler Handler, cfg Config) error {
+	sc := newServerConn(conn, buffered, handler, cfg)
+	if err := sc.cfg.validate(); err != nil {
+		conn.Close()
+		return err
+	}
+	return sc.serve(nil)
+}
+
+// ServeUpgraded continues a connection that was switched from HTTP/1.1 with
+// "Upgrade: h2c". The upgrade request becomes stream 1 and settings is the
+// value of its HTTP2-Settings header
+func ServeUpgraded(conn net.Conn, buffered []byte, req *request.Request, settings string, handler Handler, cfg Config) error {
+	sc := newServerConn(conn, buffered, handler, cfg)
+	if err := sc.cfg.validate(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(settings, "="))
+	if err != nil {
+		return fmt.Errorf("http2: bad HTTP2-Settings: %w", err)
+	}
+	parsed, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(parsed); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		delete(req.Headers, name)
+	}
+	req.RequestLine.HttpVersion = "2"
+
+	st := sc.newStream(1)
+	st.req = req
+	sc.setLastStreamID(1)
+	return sc.serve(st)
+}
+
+// IsUpgrade reports whether req asks to switch to h2c
+func IsUpgrade(req *request.Request) bool {
+	_, hasSettings := req.Headers["http2-settings"]
+	return hasSettings &&
+		req.Headers.HasToken("Upgrade", "h2c") &&
+		req.Headers.HasToken("Connection", "upgrade") &&
+		req.Headers.HasToken("Connection", "http2-settings")
+}
+
+func (sc *serverConn) serve(upgraded *stream) error {
+	defer sc.shutdown()
+
+	if err := sc.writeSettings(); err != nil {
+		return err
+	}
+	if upgraded != nil {
+		sc.dispatch(upgraded)
+	}
+	if sc.cfg.Shutdown != nil {
+		go sc.watchShutdown()
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		sc.goAway(ErrCodeProtocol)
+		return ErrBadPreface
+	}
+
+	for {
+		f, err := ReadFrame(sc.br, sc.cfg.MaxFrameSize)
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+
+		var streamErr StreamError
+		var connErr ConnError
+		switch {
+		case err == nil:
+		case errors.As(err, &streamErr):
+			sc.resetStream(streamErr.StreamID, streamErr.Code)
+		case errors.As(err, &connErr):
+			sc.goAway(connErr.Code)
+			return connErr
+		case err == io.EOF || sc.isDraining():
+			// A drained connection is closed from our side, which the
+			// read loop sees as an error
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// shutdown closes the connection and waits for handlers to notice
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	close(sc.done)
+	sc.conn.Close()
+	sc.cancel()
+	sc.handlers.Wait()
+}
+
+// watchShutdown drains the connection once the server starts shutting down
+func (sc *serverConn) watchShutdown() {
+	select {
+	case <-sc.cfg.Shutdown:
+	case <-sc.done:
+		return
+	}
+
+	sc.mu.Lock()
+	sc.draining = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.goAway(ErrCodeNo)
+	if idle {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) isDraining() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.draining
+}
+
+func (sc *serverConn) setLastStreamID(id uint32) {
+	sc.mu.Lock()
+	sc.lastStreamID = id
+	sc.mu.Unlock()
+}
+
+func (sc *serverConn) processFrame(f Frame) error {
+	if sc.continuing != nil && (f.Type != FrameContinuation || f.StreamID != sc.continuing.streamID) {
+		return ConnError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+	if !sc.sawSettings && f.Type != FrameSettings {
+		return ConnError{ErrCodeProtocol, "first frame must be SETTINGS"}
+	}
+
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize}
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return ConnError{ErrCodeProtocol, "clients cannot push"}
+	case FramePing:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.Payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "PING must be 8 bytes"}
+		}
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		// The client will open no more streams; finish the ones in flight
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	// Unknown frame types are ignored (RFC 9113 4.1)
+	return nil
+}
+
+func (sc *serverConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	sc.sawSettings = true
+	return sc.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			// Changing the initial window shifts every open stream by
+			// the difference (RFC 9113 6.9.2)
+			delta := int64(s.Value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnError{ErrCodeFlowControl, "window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Value
+		}
+		// Our encoder never uses the dynamic table, so HEADER_TABLE_SIZE
+		// needs no action. Push is never used either
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f Frame) error {
+	id := f.StreamID
+	if id == 0 || id%2 == 0 {
+		return ConnError{ErrCodeProtocol, "HEADERS on an invalid stream"}
+	}
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(payload) < 5 {
+			return ConnError{ErrCodeFrameSize, "short priority block"}
+		}
+		if binary.BigEndian.Uint32(payload)&0x7fffffff == id {
+			return StreamError{id, ErrCodeProtocol}
+		}
+		payload = payload[5:]
+	}
+
+	if id <= sc.lastStreamID {
+		// Only a trailer section may arrive on an existing stream
+		st := sc.lookupStream(id)
+		if st == nil || st.remoteClosed {
+			return ConnError{ErrCodeStreamClosed, "HEADERS on a closed stream"}
+		}
+		if !f.Has(FlagEndStream) {
+			return StreamError{id, ErrCodeProtocol}
+		}
+	}
+
+	sc.continuing = &headerBlock{
+		streamID:  id,
+		endStream: f.Has(FlagEndStream),
+		buf:       append([]byte(nil), payload...),
+	}
+	if f.Has(FlagEndHeaders) {
+		return sc.finishHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(f Frame) error {
+	if sc.continuing == nil {
+		return ConnError{ErrCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+	sc.continuing.buf = append(sc.continuing.buf, f.Payload...)
+	if len(sc.continuing.buf) > int(sc.cfg.MaxHeaderListSize) {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	if f.Has(FlagEndHeaders) {
+		return sc.finishHeaderBlock()
+	}
+	return nil
+}
+
+// finishHeaderBlock decodes a complete block. Decoding always happens, even
+// for streams we refuse, so the HPACK state stays in sync with the client
+func (sc *serverConn) finishHeaderBlock() error {
+	block := sc.continuing
+	sc.continuing = nil
+
+	fields, err := sc.hdec.Decode(block.buf)
+	if err != nil {
+		if errors.Is(err, ErrHeaderListTooLong) {
+			return StreamError{block.streamID, ErrCodeRefusedStream}
+		}
+		return ConnError{ErrCodeCompression, err.Error()}
+	}
+
+	if st := sc.lookupStream(block.streamID); st != nil {
+		trailers, err := trailerFields(fields)
+		if err != nil {
+			return StreamError{st.id, ErrCodeProtocol}
+		}
+		st.req.Trailers = trailers
+		return sc.endRequest(st)
+	}
+
+	sc.mu.Lock()
+	if sc.draining {
+		// Streams above the GOAWAY's last stream ID are ignored; the
+		// client knows to retry them elsewhere
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.lastStreamID = block.streamID
+	active := len(sc.streams)
+	sc.mu.Unlock()
+	if active >= int(sc.cfg.MaxConcurrentStreams) {
+		return StreamError{block.streamID, ErrCodeRefusedStream}
+	}
+
+	req, err := requestFromFields(fields)
+	if err != nil {
+		return StreamError{block.streamID, ErrCodeProtocol}
+	}
+
+	st := sc.newStream(block.streamID)
+	st.req = req
+	if v, ok := req.Headers["content-length"]; ok {
+		st.contentLength, _ = strconv.Atoi(v)
+	}
+	if st.contentLength > sc.cfg.MaxBodySize {
+		sc.refuseTooLarge(st)
+		return nil
+	}
+	if block.endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+// requestFromFields maps a decoded header list onto request.Request. Any
+// field HTTP/1.1 could not have carried makes the request malformed
+// (RFC 9113 8.2.1), so nothing downstream sees what the other parser rejects
+func requestFromFields(fields []HeaderField) (*request.Request, error) {
+	req := &request.Request{Headers: headers.Headers{}}
+	req.RequestLine.HttpVersion = "2"
+	var method, path, scheme, authority string
+	regular := false
+
+	for _, f := range fields {
+		if !validFieldValue(f.Value) {
+			return nil, fmt.Errorf("invalid value for %s", f.Name)
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, errors.New("pseudo-header after regular header")
+			}
+			var dst *string
+			switch f.Name {
+			case ":method":
+				dst = &method
+			case ":path":
+				dst = &path
+			case ":scheme":
+				dst = &scheme
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if *dst != "" {
+				return nil, fmt.Errorf("duplicate %s", f.Name)
+			}
+			*dst = f.Value
+			continue
+		}
+
+		regular = true
+		if !validFieldName(f.Name) {
+			return nil, fmt.Errorf("invalid header name %q", f.Name)
+		}
+		if _, banned := connectionSpecific[f.Name]; banned {
+			return nil, fmt.Errorf("connection-specific header %s", f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, errors.New("TE other than trailers")
+		}
+		appendField(req.Headers, f)
+	}
+
+	if method == "" {
+		return nil, errors.New("missing :method")
+	}
+	req.RequestLine.Method = request.Method(method)
+
+	switch {
+	case req.RequestLine.Method == request.MethodConnect:
+		// CONNECT names only the authority to tunnel to (RFC 9113 8.5)
+		if authority == "" || scheme != "" || path != "" {
+			return nil, errors.New("CONNECT needs :authority and nothing else")
+		}
+		path = authority
+	case scheme == "" || path == "":
+		return nil, errors.New("missing :scheme or :path")
+	case path == "*":
+		if req.RequestLine.Method != request.MethodOptions {
+			return nil, errors.New(`":path" of "*" outside OPTIONS`)
+		}
+	case path[0] != '/':
+		return nil, fmt.Errorf("%q is not origin-form", path)
+	}
+	req.RequestLine.RequestTarget = path
+
+	if v, ok := req.Headers["content-length"]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid content-length %q", v)
+		}
+	}
+	if authority != "" && req.Headers["host"] == "" {
+		req.Headers["host"] = authority
+	}
+	return req, nil
+}
+
+// validFieldName reports whether name is a lowercase token
+func validFieldName(name string) bool {
+	return name == strings.ToLower(name) && headers.IsToken([]byte(name))
+}
+
+// validFieldValue rejects CR, LF and NUL anywhere and whitespace at either
+// end, none of which survive the trip through HTTP/1.1 framing
+func validFieldValue(v string) bool {
+	if strings.ContainsAny(v, "\r\n\x00") {
+		return false
+	}
+	return v == strings.Trim(v, " \t")
+}
+
+func trailerFields(fields []HeaderField) (headers.Headers, error) {
+	h := headers.Headers{}
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return nil, errors.New("pseudo-header in trailers")
+		}
+		if !validFieldName(f.Name) || !validFieldValue(f.Value) {
+			return nil, fmt.Errorf("invalid trailer %q", f.Name)
+		}
+		appendField(h, f)
+	}
+	return h, nil
+}
+
+// appendField merges repeated fields the way the HTTP/1.1 parser does.
+// Cookie crumbs are rejoined with "; " (RFC 9113 8.2.3)
+func appendField(h headers.Headers, f HeaderField) {
+	existing, ok := h[f.Name]
+	switch {
+	case !ok:
+		h[f.Name] = f.Value
+	case f.Name == "cookie":
+		h[f.Name] = existing + "; " + f.Value
+	default:
+		h[f.Name] = existing + ", " + f.Value
+	}
+}
+
+func (sc *serverConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+
+	// Flow control counts the whole payload, padding included
+	n := int64(len(f.Payload))
+	sc.recvWindow -= n
+	if sc.recvWindow < 0 {
+		return ConnError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+
+	st := sc.lookupStream(f.StreamID)
+	if st == nil || st.remoteClosed {
+		if f.StreamID > sc.lastStreamID && !sc.isDraining() {
+			return ConnError{ErrCodeProtocol, "DATA on an idle stream"}
+		}
+		// Still return the credit so the connection window does not leak
+		if err := sc.creditWindow(nil, n); err != nil {
+			return err
+		}
+		return StreamError{f.StreamID, ErrCodeStreamClosed}
+	}
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	st.recvWindow -= n
+	size := len(st.req.Body) + len(data)
+	refused := false
+	switch {
+	case st.recvWindow < 0:
+		err = StreamError{st.id, ErrCodeFlowControl}
+	case st.contentLength >= 0 && size > st.contentLength:
+		err = StreamError{st.id, ErrCodeProtocol}
+	case size > sc.cfg.MaxBodySize:
+		sc.refuseTooLarge(st)
+		refused = true
+	}
+	if err != nil || refused {
+		if cerr := sc.creditWindow(nil, n); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	st.req.Body = append(st.req.Body, data...)
+
+	// The body is buffered in full, so the credit goes straight back
+	if err := sc.creditWindow(st, n); err != nil {
+		return err
+	}
+
+	if f.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+// refuseTooLarge answers 413 to a request whose body is over MaxBodySize,
+// then resets the stream with NO_ERROR so the client stops sending the
+// rest (RFC 9113 8.1)
+func (sc *serverConn) refuseTooLarge(st *stream) {
+	fields := []HeaderField{{":status", strconv.Itoa(int(response.StatusContentTooLarge))}, {"content-length", "0"}}
+	_ = st.writeHeaderBlock(fields, true)
+	sc.resetStream(st.id, ErrCodeNo)
+}
+
+// creditWindow hands n bytes of receive window back to the client on the
+// connection and, when st is not nil, on the stream
+func (sc *serverConn) creditWindow(st *stream, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	sc.recvWindow += n
+	inc := binary.BigEndian.AppendUint32(nil, uint32(n))
+	if err := sc.writeFrame(Frame{Type: FrameWindowUpdate, Payload: inc}); err != nil {
+		return err
+	}
+	if st == nil {
+		return nil
+	}
+	st.recvWindow += n
+	return sc.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: st.id, Payload: inc})
+}
+
+func (sc *serverConn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "RST_STREAM must be 4 bytes"}
+	}
+	if f.StreamID > sc.lastStreamID {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	sc.mu.Lock()
+	if st, ok := sc.streams[f.StreamID]; ok {
+		st.abort()
+		delete(sc.streams, f.StreamID)
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes"}
+	}
+	inc := int64(binary.BigEndian.Uint32(f.Payload) & 0x7fffffff)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if inc == 0 {
+			return ConnError{ErrCodeProtocol, "zero window increment"}
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st, ok := sc.streams[f.StreamID]
+	if !ok {
+		// Updates may race with a stream closing; that is fine
+		return nil
+	}
+	if inc == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol}
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	st := &stream{id: id, sc: sc, recvWindow: int64(sc.cfg.InitialWindowSize), contentLength: -1}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	return st
+}
+
+func (sc *serverConn) lookupStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams[id]
+}
+
+// endRequest dispatches st once the client has finished sending, unless
+// the body falls short of its content-length (RFC 9113 8.1.1)
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.contentLength >= 0 && len(st.req.Body) != st.contentLength {
+		return StreamError{st.id, ErrCodeProtocol}
+	}
+	sc.dispatch(st)
+	return nil
+}
+
+// dispatch runs the handler once the client has finished sending
+func (sc *serverConn) dispatch(st *stream) {
+	st.remoteClosed = true
+	ctx, cancel := context.WithCancel(sc.ctx)
+	st.req.SetContext(ctx)
+	st.req.RemoteAddr = sc.conn.RemoteAddr().String()
+	sc.mu.Lock()
+	st.cancel = cancel
+	sc.mu.Unlock()
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer cancel()
+		w := response.NewSinkWriter(st)
+		sc.handler(w, st.req)
+		st.finish()
+	}()
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	delete(sc.streams, st.id)
+	drained := sc.draining && len(sc.streams) == 0
+	sc.mu.Unlock()
+	if drained {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st, ok := sc.streams[id]; ok {
+		st.abort()
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	_ = sc.writeFrame(Frame{Type: FrameRSTStream, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, uint32(code))})
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	_ = sc.writeFrame(Frame{Type: FrameGoAway, Payload: payload})
+}
+
+// writeSettings sends our SETTINGS. The connection window is not covered by
+// INITIAL_WINDOW_SIZE, so a larger stream window is matched on stream 0
+// with a WINDOW_UPDATE
+func (sc *serverConn) writeSettings() error {
+	payload := appendSettings(nil, []Setting{
+		{SettingMaxConcurrentStreams, sc.cfg.MaxConcurrentStreams},
+		{SettingMaxHeaderListSize, sc.cfg.MaxHeaderListSize},
+		{SettingInitialWindowSize, sc.cfg.InitialWindowSize},
+		{SettingMaxFrameSize, sc.cfg.MaxFrameSize},
+		{SettingEnablePush, 0},
+	})
+	frames := []Frame{{Type: FrameSettings, Payload: payload}}
+	if extra := sc.cfg.InitialWindowSize - defaultWindowSize; sc.cfg.InitialWindowSize > defaultWindowSize {
+		frames = append(frames, Frame{Type: FrameWindowUpdate, Payload: binary.BigEndian.AppendUint32(nil, extra)})
+	}
+	return sc.writeFrame(frames...)
+}
+
+func (sc *serverConn) writeFrame(frames ...Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	var buf []byte
+	for _, f := range frames {
+		buf = AppendFrame(buf, f)
+	}
+	if _, err := sc.bw.Write(buf); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
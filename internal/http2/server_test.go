@@ -0,0 +1,440 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is just enough of an HTTP/2 client to drive serverConn
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	hdec *Decoder
+}
+
+// dial starts ServeConn on one end of a loopback connection and returns a
+// client on the other end that has already sent the preface and settings
+func dial(t *testing.T, handler Handler, cfg Config, settings ...Setting) *testClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = ServeConn(conn, nil, handler, cfg)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), hdec: NewDecoder(4096)}
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.write(Frame{Type: FrameSettings, Payload: appendSettings(nil, settings)})
+	return c
+}
+
+func (c *testClient) write(f Frame) {
+	c.t.Helper()
+	_, err := c.conn.Write(AppendFrame(nil, f))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) read() Frame {
+	c.t.Helper()
+	f, err := ReadFrame(c.br, maxAllowedFrameSize)
+	require.NoError(c.t, err)
+	return f
+}
+
+func (c *testClient) request(id uint32, method, path string, endStream bool) {
+	block := Encoder{}.Encode(nil, []HeaderField{
+		{":method", method},
+		{":scheme", "http"},
+		{":path", path},
+		{":authority", "localhost"},
+	})
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.write(Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: block})
+}
+
+type testResponse struct {
+	fields []HeaderField
+	body   []byte
+}
+
+func (r testResponse) get(name string) string {
+	for _, f := range r.fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// response reads frames until stream id ends, handling connection frames
+// along the way. onData sees every DATA frame as it arrives
+func (c *testClient) response(id uint32, onData func(Frame)) testResponse {
+	c.t.Helper()
+	var resp testResponse
+	for {
+		f := c.read()
+		if f.StreamID != id {
+			continue
+		}
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.hdec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			resp.fields = append(resp.fields, fields...)
+		case FrameData:
+			resp.body = append(resp.body, f.Payload...)
+			if onData != nil {
+				onData(f)
+			}
+		case FrameRSTStream:
+			c.t.Fatalf("stream %d reset with code %d", id, binary.BigEndian.Uint32(f.Payload))
+		}
+		if f.Has(FlagEndStream) {
+			return resp
+		}
+	}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := []byte(string(req.RequestLine.Method) + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+	_ = w.WriteStatusLine(response.StatusOK)
+	h := response.GetDefaultHeaders(len(body))
+	h["connection"] = "keep-alive"
+	_ = w.WriteHeaders(h)
+	_, _ = w.WriteBody(body)
+}
+
+func TestServeConn(t *testing.T) {
+	c := dial(t, echoHandler, Config{})
+
+	// Test: The server opens with SETTINGS that disable push
+	f := c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	settings, err := parseSettings(f.Payload)
+	require.NoError(t, err)
+	assert.Contains(t, settings, Setting{SettingEnablePush, 0})
+
+	// Test: GET without a body
+	c.request(1, "GET", "/hello", true)
+	resp := c.response(1, nil)
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, "text/plain", resp.get("content-type"))
+	assert.Empty(t, resp.get("connection"))
+	assert.Equal(t, "GET /hello ", string(resp.body))
+
+	// Test: POST with the body split over DATA frames
+	c.request(3, "POST", "/submit", false)
+	c.write(Frame{Type: FrameData, StreamID: 3, Payload: []byte("part one, ")})
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 3, Payload: []byte("part two")})
+	resp = c.response(3, nil)
+	assert.Equal(t, "POST /submit part one, part two", string(resp.body))
+
+	// Test: PING is acknowledged with the same payload
+	c.write(Frame{Type: FramePing, Payload: []byte("12345678")})
+	for {
+		f = c.read()
+		if f.Type == FramePing {
+			break
+		}
+	}
+	assert.True(t, f.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+}
+
+func TestFlowControl(t *testing.T) {
+	body := make([]byte, 25)
+	c := dial(t, func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody(body)
+	}, Config{}, Setting{SettingInitialWindowSize, 10})
+
+	c.request(1, "GET", "/", true)
+
+	// Test: The server stops at the advertised window and resumes once
+	// the client grants more
+	received := 0
+	resp := c.response(1, func(f Frame) {
+		received += len(f.Payload)
+		assert.LessOrEqual(t, received, 10+15)
+		if received == 10 {
+			c.write(Frame{Type: FrameWindowUpdate, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, 15)})
+		}
+	})
+	assert.Len(t, resp.body, 25)
+	assert.Equal(t, strconv.Itoa(len(body)), resp.get("content-length"))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	readGoAway := func(c *testClient) ErrCode {
+		for {
+			f := c.read()
+			if f.Type == FrameGoAway {
+				return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+			}
+		}
+	}
+
+	// Test: HEADERS on an even stream ID ends the connection
+	c := dial(t, echoHandler, Config{})
+	c.request(2, "GET", "/", true)
+	assert.Equal(t, ErrCodeProtocol, readGoAway(c))
+
+	// Test: A malformed request only resets its stream
+	c = dial(t, echoHandler, Config{})
+	block := Encoder{}.Encode(nil, []HeaderField{{":method", "GET"}, {":path", "/"}})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+	for {
+		f := c.read()
+		if f.Type == FrameRSTStream {
+			assert.Equal(t, uint32(1), f.StreamID)
+			assert.Equal(t, uint32(ErrCodeProtocol), binary.BigEndian.Uint32(f.Payload))
+			break
+		}
+	}
+
+	// Test: Anything but CONTINUATION while a header block is open
+	c = dial(t, echoHandler, Config{})
+	block = Encoder{}.Encode(nil, []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}})
+	c.write(Frame{Type: FrameHeaders, StreamID: 1, Payload: block})
+	c.write(Frame{Type: FramePing, Payload: make([]byte, 8)})
+	assert.Equal(t, ErrCodeProtocol, readGoAway(c))
+}
+
+func TestStreamContext(t *testing.T) {
+	started, result := make(chan struct{}), make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			result <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			result <- nil
+		}
+	}
+
+	// Test: RST_STREAM from the client cancels the handler's context
+	c := dial(t, handler, Config{})
+	c.request(1, "GET", "/", true)
+	<-started
+	c.write(Frame{Type: FrameRSTStream, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))})
+	require.ErrorIs(t, <-result, context.Canceled)
+
+	// Test: So does the connection closing
+	started, result = make(chan struct{}), make(chan error, 1)
+	c = dial(t, handler, Config{})
+	c.request(1, "GET", "/", true)
+	<-started
+	c.conn.Close()
+	require.ErrorIs(t, <-result, context.Canceled)
+}
+
+func TestConnectionSettings(t *testing.T) {
+	// Test: Configured values are advertised, and a stream window above the
+	// default is matched on the connection window
+	c := dial(t, echoHandler, Config{MaxConcurrentStreams: 8, InitialWindowSize: 1 << 20, MaxFrameSize: 1 << 15})
+	f := c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	settings, err := parseSettings(f.Payload)
+	require.NoError(t, err)
+	assert.Contains(t, settings, Setting{SettingMaxConcurrentStreams, 8})
+	assert.Contains(t, settings, Setting{SettingInitialWindowSize, 1 << 20})
+	assert.Contains(t, settings, Setting{SettingMaxFrameSize, 1 << 15})
+	assert.Contains(t, settings, Setting{SettingEnablePush, 0})
+
+	f = c.read()
+	require.Equal(t, FrameWindowUpdate, f.Type)
+	assert.Equal(t, uint32(0), f.StreamID)
+	assert.Equal(t, uint32(1<<20-defaultWindowSize), binary.BigEndian.Uint32(f.Payload))
+
+	// Test: Frames up to the advertised size are accepted
+	c.request(1, "POST", "/big", false)
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 1, Payload: make([]byte, 1<<15)})
+	resp := c.response(1, nil)
+	assert.Len(t, resp.body, len("POST /big ")+1<<15)
+
+	// Test: Settings the protocol forbids are refused up front
+	server, client := net.Pipe()
+	defer client.Close()
+	err = ServeConn(server, nil, echoHandler, Config{MaxFrameSize: 100})
+	require.Error(t, err)
+}
+
+// readReset reads frames until stream id is reset and returns the code
+func (c *testClient) readReset(id uint32) ErrCode {
+	c.t.Helper()
+	for {
+		f := c.read()
+		if f.Type == FrameRSTStream && f.StreamID == id {
+			return ErrCode(binary.BigEndian.Uint32(f.Payload))
+		}
+		if f.StreamID == id && f.Type != FrameWindowUpdate {
+			c.t.Fatalf("stream %d got frame type %d instead of RST_STREAM", id, f.Type)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	base := []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "localhost"}}
+	with := func(fields ...HeaderField) []HeaderField {
+		return append(append([]HeaderField(nil), base...), fields...)
+	}
+
+	// Test: Fields HTTP/1.1 could not carry, and targets that are not
+	// origin-form, reset the stream
+	for name, fields := range map[string][]HeaderField{
+		"uppercase name":            with(HeaderField{"X-Thing", "a"}),
+		"non-token name":            with(HeaderField{"x thing", "a"}),
+		"empty name":                with(HeaderField{"", "a"}),
+		"CR in value":               with(HeaderField{"x-thing", "a\rb"}),
+		"LF in value":               with(HeaderField{"x-thing", "a\nb"}),
+		"NUL in value":              with(HeaderField{"x-thing", "a\x00b"}),
+		"leading space":             with(HeaderField{"x-thing", " a"}),
+		"trailing tab":              with(HeaderField{"x-thing", "a\t"}),
+		"LF in pseudo-header":       {{":method", "GET"}, {":scheme", "http"}, {":path", "/\nx"}},
+		"absolute path":             {{":method", "GET"}, {":scheme", "http"}, {":path", "http://x/"}},
+		"asterisk for GET":          {{":method", "GET"}, {":scheme", "http"}, {":path", "*"}},
+		"CONNECT with path":         {{":method", "CONNECT"}, {":scheme", "http"}, {":path", "/"}, {":authority", "x:443"}},
+		"CONNECT without authority": {{":method", "CONNECT"}},
+		"bad content-length":        with(HeaderField{"content-length", "-1"}),
+	} {
+		c := dial(t, echoHandler, Config{})
+		c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: Encoder{}.Encode(nil, fields)})
+		assert.Equal(t, ErrCodeProtocol, c.readReset(1), name)
+	}
+
+	// Test: OPTIONS may use "*", and CONNECT gets its authority as the target
+	c := dial(t, echoHandler, Config{})
+	block := Encoder{}.Encode(nil, []HeaderField{{":method", "OPTIONS"}, {":scheme", "http"}, {":path", "*"}})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+	assert.Equal(t, "OPTIONS * ", string(c.response(1, nil).body))
+	block = Encoder{}.Encode(nil, []HeaderField{{":method", "CONNECT"}, {":authority", "example.com:443"}})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 3, Payload: block})
+	assert.Equal(t, "CONNECT example.com:443 ", string(c.response(3, nil).body))
+
+	// Test: The body must match a declared content-length, whether it runs
+	// short or long
+	post := func(c *testClient, id uint32, length string, endHeaders bool) {
+		fields := []HeaderField{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}, {"content-length", length}}
+		flags := FlagEndHeaders
+		if endHeaders {
+			flags |= FlagEndStream
+		}
+		c.write(Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: Encoder{}.Encode(nil, fields)})
+	}
+	c = dial(t, echoHandler, Config{})
+	post(c, 1, "5", false)
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 1, Payload: []byte("abc")})
+	assert.Equal(t, ErrCodeProtocol, c.readReset(1))
+	post(c, 3, "2", false)
+	c.write(Frame{Type: FrameData, StreamID: 3, Payload: []byte("abc")})
+	assert.Equal(t, ErrCodeProtocol, c.readReset(3))
+	post(c, 5, "1", true)
+	assert.Equal(t, ErrCodeProtocol, c.readReset(5))
+	post(c, 7, "3", false)
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 7, Payload: []byte("abc")})
+	assert.Equal(t, "POST / abc", string(c.response(7, nil).body))
+}
+
+func TestReceiveWindow(t *testing.T) {
+	// Test: DATA beyond a stream's window resets that stream
+	c := dial(t, echoHandler, Config{InitialWindowSize: 10})
+	c.request(1, "POST", "/", false)
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 8)})
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 8)})
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 11)})
+	assert.Equal(t, ErrCodeFlowControl, c.readReset(1))
+
+	// Test: DATA beyond the connection window ends the connection
+	c = dial(t, echoHandler, Config{MaxFrameSize: 1 << 17})
+	c.request(1, "POST", "/", false)
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, defaultWindowSize+1)})
+	for {
+		f := c.read()
+		if f.Type == FrameGoAway {
+			assert.Equal(t, ErrCodeFlowControl, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+			break
+		}
+	}
+}
+
+func TestHeaderListTooLong(t *testing.T) {
+	c := dial(t, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.Headers.Get("x-tag"))
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody(body)
+	}, Config{MaxHeaderListSize: 200})
+	request := []HeaderField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}}
+
+	// Test: A block over the limit refuses only its stream
+	block := Encoder{}.Encode(nil, append(request, HeaderField{"x-big", strings.Repeat("a", 300)}))
+	block = appendString(appendString(append(block, 0x40), "x-tag"), "tagged")
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+	assert.Equal(t, ErrCodeRefusedStream, c.readReset(1))
+
+	// Test: Entries it added to the dynamic table can still be referenced
+	block = append(Encoder{}.Encode(nil, request), 0x80|byte(len(staticTable)+1))
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 3, Payload: block})
+	assert.Equal(t, "tagged", string(c.response(3, nil).body))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	c := dial(t, echoHandler, Config{MaxBodySize: 4})
+	readStatus := func(id uint32) string {
+		for {
+			f := c.read()
+			if f.Type == FrameHeaders && f.StreamID == id {
+				require.True(t, f.Has(FlagEndStream))
+				fields, err := c.hdec.Decode(f.Payload)
+				require.NoError(t, err)
+				return testResponse{fields: fields}.get(":status")
+			}
+		}
+	}
+
+	// Test: A body that grows past the cap is answered with 413, then the
+	// stream is reset without an error
+	c.request(1, "POST", "/", false)
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: []byte("hel")})
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: []byte("lo")})
+	assert.Equal(t, "413", readStatus(1))
+	assert.Equal(t, ErrCodeNo, c.readReset(1))
+
+	// Test: So is a declared length over the cap, before any DATA
+	block := Encoder{}.Encode(nil, []HeaderField{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}, {"content-length", "5"}})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 3, Payload: block})
+	assert.Equal(t, "413", readStatus(3))
+
+	// Test: A body at the cap is fine
+	c.request(5, "POST", "/", false)
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 5, Payload: []byte("abcd")})
+	assert.Equal(t, "POST / abcd", string(c.response(5, nil).body))
+}
@@ -0,0 +1,163 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var ErrStreamClosed = errors.New("http2: stream closed")
+
+// stream is one request/response exchange. It implements response.Sink so
+// the handler's Writer turns into HEADERS and DATA frames
+type stream struct {
+	id  uint32
+	sc  *serverConn
+	req *request.Request
+
+	// Only touched by the read loop. recvWindow is what the client may
+	// still send, and contentLength is the declared body size or -1
+	remoteClosed  bool
+	recvWindow    int64
+	contentLength int
+
+	// Guarded by sc.mu
+	sendWindow int64
+	reset      bool
+	// cancel ends the handler's request context
+	cancel context.CancelFunc
+
+	// Only touched by the handler goroutine
+	headersSent bool
+	ended       bool
+}
+
+// abort marks the stream reset and cancels its request context. The
+// caller holds sc.mu
+func (st *stream) abort() {
+	st.reset = true
+	if st.cancel != nil {
+		st.cancel()
+	}
+}
+
+func (st *stream) WriteHeader(status response.StatusCode, h response.Headers) error {
+	fields := []HeaderField{{":status", strconv.Itoa(int(status))}}
+	fields = appendHeaderFields(fields, h)
+	if err := st.writeHeaderBlock(fields, false); err != nil {
+		return err
+	}
+	st.headersSent = true
+	return nil
+}
+
+func (st *stream) WriteData(p []byte) error {
+	for len(p) > 0 {
+		n, err := st.sc.awaitWindow(st, len(p))
+		if err != nil {
+			return err
+		}
+		if err := st.sc.writeFrame(Frame{Type: FrameData, StreamID: st.id, Payload: p[:n]}); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (st *stream) WriteTrailers(h response.Headers) error {
+	if err := st.writeHeaderBlock(appendHeaderFields(nil, h), true); err != nil {
+		return err
+	}
+	st.ended = true
+	return nil
+}
+
+// finish ends the stream after the handler returns. A handler that never
+// sent headers gets its stream reset, as there is nothing to end cleanly
+func (st *stream) finish() {
+	defer st.sc.closeStream(st)
+
+	st.sc.mu.Lock()
+	reset := st.reset
+	st.sc.mu.Unlock()
+	switch {
+	case reset || st.ended:
+	case !st.headersSent:
+		st.sc.resetStream(st.id, ErrCodeInternal)
+	default:
+		_ = st.sc.writeFrame(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: st.id})
+	}
+}
+
+// writeHeaderBlock sends HEADERS plus as many CONTINUATIONs as the peer's
+// frame size requires, in one write so no other frame lands in between
+func (st *stream) writeHeaderBlock(fields []HeaderField, endStream bool) error {
+	block := st.sc.henc.Encode(nil, fields)
+
+	st.sc.mu.Lock()
+	if st.reset || st.sc.closed {
+		st.sc.mu.Unlock()
+		return ErrStreamClosed
+	}
+	maxSize := int(st.sc.peerMaxFrameSize)
+	st.sc.mu.Unlock()
+
+	var frames []Frame
+	first := true
+	for first || len(block) > 0 {
+		n := min(len(block), maxSize)
+		f := Frame{Type: FrameContinuation, StreamID: st.id, Payload: block[:n]}
+		if first {
+			f.Type = FrameHeaders
+			if endStream {
+				f.Flags |= FlagEndStream
+			}
+			first = false
+		}
+		block = block[n:]
+		if len(block) == 0 {
+			f.Flags |= FlagEndHeaders
+		}
+		frames = append(frames, f)
+	}
+	return st.sc.writeFrame(frames...)
+}
+
+// appendHeaderFields converts response headers, dropping the ones HTTP/2
+// forbids. Headers keys are already lowercase
+func appendHeaderFields(fields []HeaderField, h response.Headers) []HeaderField {
+	for k, v := range h {
+		if _, banned := connectionSpecific[k]; banned {
+			continue
+		}
+		for _, line := range headers.Lines(v) {
+			fields = append(fields, HeaderField{k, line})
+		}
+	}
+	return fields
+}
+
+// awaitWindow blocks until some of want bytes may be sent and reserves
+// them from both the stream and connection windows
+func (sc *serverConn) awaitWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.reset || sc.closed {
+			return 0, ErrStreamClosed
+		}
+		avail := min(st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		if avail > 0 {
+			n := int(min(avail, int64(want)))
+			st.sendWindow -= int64(n)
+			sc.sendWindow -= int64(n)
+			return n, nil
+		}
+		sc.cond.Wait()
+	}
+}
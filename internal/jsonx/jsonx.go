@@ -0,0 +1,183 @@
+package jsonx
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var (
+	ErrUnsupportedMediaType = errors.New("request body is not JSON")
+	ErrBodyTooLarge         = errors.New("request body exceeds the size limit")
+	ErrMalformed            = errors.New("request body is not valid JSON")
+	ErrUnknownField         = errors.New("request body has an unknown field")
+	ErrInvalidValue         = errors.New("request body has a value of the wrong type")
+	ErrValidation           = errors.New("request body failed validation")
+)
+
+// Validator is implemented by request types that check their own contents
+// once decoded
+type Validator interface {
+	Validate() error
+}
+
+type DecodeOptions struct {
+	// MaxBytes caps the body. Zero means 1MiB
+	MaxBytes int64
+	// AllowUnknownFields turns off the strict field check
+	AllowUnknownFields bool
+}
+
+// Decode reads req.Body into dst. The body must be a single JSON value
+// sent as application/json or a +json type, and may only use fields dst
+// declares. If dst is a Validator it is validated as well. Errors wrap one
+// of the package's sentinels, which ProblemFor turns into a response
+func Decode(req *request.Request, dst any, opts DecodeOptions) error {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	if !isJSON(req.Headers.Get("Content-Type")) {
+		return ErrUnsupportedMediaType
+	}
+	if int64(len(req.Body)) > opts.MaxBytes {
+		return ErrBodyTooLarge
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(req.Body))
+	if !opts.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after the top-level value", ErrMalformed)
+	}
+
+	if v, ok := dst.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrValidation, err)
+		}
+	}
+	return nil
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeError maps encoding/json errors onto the sentinels. The unknown
+// field error has no type of its own, so it is recognised by its text
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: empty body", ErrMalformed)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: body ends mid-value", ErrMalformed)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w: %v at offset %d", ErrMalformed, syntaxErr, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Errorf("%w: field %q must be %s", ErrInvalidValue, typeErr.Field, typeErr.Type)
+		}
+		return fmt.Errorf("%w: expected %s", ErrInvalidValue, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("%w: %s", ErrUnknownField, strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return fmt.Errorf("%w: %v", ErrMalformed, err)
+}
+
+// Write sends v as a complete JSON response
+func Write(w *response.Writer, status response.StatusCode, v any) error {
+	return write(w, status, "application/json", v)
+}
+
+func write(w *response.Writer, status response.StatusCode, contentType string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+// Problem is an RFC 9457 problem details object
+type Problem struct {
+	// Type is a URI naming the problem type. Empty means "about:blank"
+	Type string
+	// Title is a short summary of the type. Empty means the status text
+	Title    string
+	Status   response.StatusCode
+	Detail   string
+	Instance string
+	// Extensions are extra members, written alongside the standard ones
+	Extensions map[string]any
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = cmp.Or(p.Type, "about:blank")
+	if title := cmp.Or(p.Title, response.StatusText(p.Status)); title != "" {
+		m["title"] = title
+	}
+	m["status"] = int(p.Status)
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// WriteProblem sends p as application/problem+json
+func WriteProblem(w *response.Writer, p Problem) error {
+	if p.Status == 0 {
+		p.Status = response.StatusInternalServerError
+	}
+	return write(w, p.Status, "application/problem+json", p)
+}
+
+// ProblemFor turns an error from Decode into the matching problem. Errors
+// from elsewhere become a 500 without detail, so nothing internal leaks
+func ProblemFor(err error) Problem {
+	var status response.StatusCode
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		status = response.StatusUnsupportedMediaType
+	case errors.Is(err, ErrBodyTooLarge):
+		status = response.StatusContentTooLarge
+	case errors.Is(err, ErrMalformed), errors.Is(err, ErrUnknownField):
+		status = response.StatusBadRequest
+	case errors.Is(err, ErrInvalidValue), errors.Is(err, ErrValidation):
+		status = response.StatusUnprocessableContent
+	default:
+		return Problem{Status: response.StatusInternalServerError}
+	}
+	return Problem{Status: status, Detail: err.Error()}
+}
@@ -0,0 +1,149 @@
+package jsonx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type createUser struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (u createUser) Validate() error {
+	if u.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func jsonRequest(contentType, body string) *request.Request {
+	return &request.Request{
+		Headers: headers.Headers{"content-type": contentType},
+		Body:    []byte(body),
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// Test: Valid body, with and without a charset or +json suffix
+	for _, ct := range []string{"application/json", "application/json; charset=utf-8", "application/vnd.api+json"} {
+		var u createUser
+		require.NoError(t, Decode(jsonRequest(ct, `{"name":"ada","age":36}`), &u, DecodeOptions{}))
+		assert.Equal(t, createUser{Name: "ada", Age: 36}, u)
+	}
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		opts        DecodeOptions
+		err         error
+		detail      string
+	}{
+		{"wrong type", "text/plain", `{}`, DecodeOptions{}, ErrUnsupportedMediaType, ""},
+		{"missing type", "", `{}`, DecodeOptions{}, ErrUnsupportedMediaType, ""},
+		{"too large", "application/json", `{"name":"ada"}`, DecodeOptions{MaxBytes: 5}, ErrBodyTooLarge, ""},
+		{"empty", "application/json", ``, DecodeOptions{}, ErrMalformed, "empty body"},
+		{"truncated", "application/json", `{"name":`, DecodeOptions{}, ErrMalformed, "mid-value"},
+		{"syntax", "application/json", `{"name" "ada"}`, DecodeOptions{}, ErrMalformed, "offset"},
+		{"trailing", "application/json", `{"name":"ada"} {}`, DecodeOptions{}, ErrMalformed, "after the top-level value"},
+		{"unknown field", "application/json", `{"name":"ada","admin":true}`, DecodeOptions{}, ErrUnknownField, `"admin"`},
+		{"bad type", "application/json", `{"name":"ada","age":"old"}`, DecodeOptions{}, ErrInvalidValue, `field "age" must be int`},
+		{"validation", "application/json", `{"age":3}`, DecodeOptions{}, ErrValidation, "name is required"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var u createUser
+			err := Decode(jsonRequest(tc.contentType, tc.body), &u, tc.opts)
+			require.ErrorIs(t, err, tc.err)
+			assert.Contains(t, err.Error(), tc.detail)
+		})
+	}
+
+	// Test: Unknown fields can be allowed
+	var u createUser
+	require.NoError(t, Decode(jsonRequest("application/json", `{"name":"ada","admin":true}`), &u, DecodeOptions{AllowUnknownFields: true}))
+}
+
+// roundTrip runs write against a fresh Writer and parses the output
+func roundTrip(t *testing.T, write func(w *response.Writer) error) (*http.Response, []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, write(response.NewWriter(&out)))
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func TestWrite(t *testing.T) {
+	resp, body := roundTrip(t, func(w *response.Writer) error {
+		return Write(w, response.StatusOK, createUser{Name: "ada", Age: 36})
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	assert.JSONEq(t, `{"name":"ada","age":36}`, string(body))
+
+	// Test: Marshal failures are reported before anything is written
+	var out bytes.Buffer
+	err := Write(response.NewWriter(&out), response.StatusOK, make(chan int))
+	require.Error(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestProblem(t *testing.T) {
+	// Test: Defaults and extension members
+	resp, body := roundTrip(t, func(w *response.Writer) error {
+		return WriteProblem(w, Problem{
+			Status:     response.StatusForbidden,
+			Detail:     "your account has no credit",
+			Instance:   "/account/12345/msgs/abc",
+			Extensions: map[string]any{"balance": 30},
+		})
+	})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"type": "about:blank",
+		"title": "Forbidden",
+		"status": 403,
+		"detail": "your account has no credit",
+		"instance": "/account/12345/msgs/abc",
+		"balance": 30
+	}`, string(body))
+
+	// Test: Standard members win over extensions of the same name
+	raw, err := json.Marshal(Problem{Type: "https://example.com/probs/out-of-credit", Title: "Out of credit", Status: 403, Extensions: map[string]any{"status": 200}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"https://example.com/probs/out-of-credit","title":"Out of credit","status":403}`, string(raw))
+
+	// Test: Decode errors map to statuses
+	var u createUser
+	err = Decode(jsonRequest("application/json", `{"name":"ada","age":"old"}`), &u, DecodeOptions{})
+	p := ProblemFor(err)
+	assert.Equal(t, response.StatusUnprocessableContent, p.Status)
+	assert.Contains(t, p.Detail, "age")
+	assert.Equal(t, response.StatusUnsupportedMediaType, ProblemFor(ErrUnsupportedMediaType).Status)
+	assert.Equal(t, response.StatusContentTooLarge, ProblemFor(ErrBodyTooLarge).Status)
+	assert.Equal(t, response.StatusBadRequest, ProblemFor(ErrUnknownField).Status)
+
+	// Test: Other errors give a bare 500
+	p = ProblemFor(errors.New("database password is hunter2"))
+	assert.Equal(t, response.StatusInternalServerError, p.Status)
+	assert.Empty(t, p.Detail)
+	assert.False(t, strings.Contains(p.Title, "hunter2"))
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// family is one named metric and its series, one per combination of label
+// values
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	// buckets are the histogram upper bounds in increasing order
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	// value is a counter or gauge's value, and sum a histogram's
+	value float64
+	// counts holds per-bucket observations, not yet cumulative
+	counts []uint64
+	count  uint64
+}
+
+func newFamily(name, help, typ string, buckets []float64, labels ...string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	// Unlabelled metrics are exposed from the start, at zero
+	if len(labels) == 0 {
+		f.get()
+	}
+	return f
+}
+
+// get returns the series for values, creating it. f.mu must be held unless
+// f is not shared yet
+func (f *family) get(values ...string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: values}
+		if f.typ == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter or gauge
+func (f *family) add(v float64, values ...string) {
+	f.mu.Lock()
+	f.get(values...).value += v
+	f.mu.Unlock()
+}
+
+// observe records v in a histogram
+func (f *family) observe(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(values...)
+	if i, _ := slices.BinarySearch(f.buckets, v); i < len(f.buckets) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+}
+
+// write renders the family in the Prometheus text exposition format
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		labels := f.labelPairs(s.values)
+		if f.typ != typeHistogram {
+			writeSample(w, f.name, labels, "", s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, f.name+"_bucket", labels, formatFloat(le), float64(cumulative))
+		}
+		writeSample(w, f.name+"_bucket", labels, "+Inf", float64(s.count))
+		writeSample(w, f.name+"_sum", labels, "", s.value)
+		writeSample(w, f.name+"_count", labels, "", float64(s.count))
+	}
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = f.labels[i] + `="` + escapeLabel(v) + `"`
+	}
+	return pairs
+}
+
+// writeSample writes one line. le, if set, is added as the last label
+func writeSample(w *bufio.Writer, name string, labels []string, le string, v float64) {
+	w.WriteString(name)
+	if le != "" {
+		labels = append(slices.Clip(labels), `le="`+le+`"`)
+	}
+	if len(labels) > 0 {
+		w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// writeFamilies renders every family in order
+func writeFamilies(out io.Writer, families []*family) error {
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		f.write(w)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// DefaultLatencyBuckets are in seconds, from 5ms to 10s
+	DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// DefaultSizeBuckets are in bytes, from 64B to 16MiB in powers of 4
+	DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+)
+
+type Options struct {
+	// LatencyBuckets defaults to DefaultLatencyBuckets
+	LatencyBuckets []float64
+	// SizeBuckets defaults to DefaultSizeBuckets
+	SizeBuckets []float64
+}
+
+func (o Options) withDefaults() Options {
+	if len(o.LatencyBuckets) == 0 {
+		o.LatencyBuckets = DefaultLatencyBuckets
+	}
+	if len(o.SizeBuckets) == 0 {
+		o.SizeBuckets = DefaultSizeBuckets
+	}
+	return o
+}
+
+// Metrics collects server instrumentation. Its Middleware counts requests,
+// and passing it to server.WithObserver counts connections and parse
+// errors. Handler serves everything it has collected
+type Metrics struct {
+	requests     *family
+	duration     *family
+	requestSize  *family
+	responseSize *family
+	inFlight     *family
+	openConns    *family
+	connsTotal   *family
+	parseErrors  *family
+
+	families []*family
+}
+
+func New(opts Options) *Metrics {
+	opts = opts.withDefaults()
+	m := &Metrics{
+		requests: newFamily("http_requests_total",
+			"Requests served, by method and status.", typeCounter, nil, "method", "status"),
+		duration: newFamily("http_request_duration_seconds",
+			"Time from the request being parsed to the handler returning.", typeHistogram, opts.LatencyBuckets, "method"),
+		requestSize: newFamily("http_request_size_bytes",
+			"Request body sizes.", typeHistogram, opts.SizeBuckets),
+		responseSize: newFamily("http_response_size_bytes",
+			"Response body sizes as sent.", typeHistogram, opts.SizeBuckets),
+		inFlight: newFamily("http_requests_in_flight",
+			"Requests being handled.", typeGauge, nil),
+		openConns: newFamily("http_open_connections",
+			"Connections open.", typeGauge, nil),
+		connsTotal: newFamily("http_connections_total",
+			"Connections accepted.", typeCounter, nil),
+		parseErrors: newFamily("http_parse_errors_total",
+			"Requests that could not be parsed, by error type.", typeCounter, nil, "type"),
+	}
+	m.families = []*family{
+		m.requests, m.duration, m.requestSize, m.responseSize,
+		m.inFlight, m.openConns, m.connsTotal, m.parseErrors,
+	}
+	return m
+}
+
+// Middleware records every request
+func (m *Metrics) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			m.inFlight.add(1)
+			defer m.inFlight.add(-1)
+
+			next(w, req)
+
+			method := methodLabel(req.RequestLine.Method)
+			m.requests.add(1, method, strconv.Itoa(int(w.Status())))
+			m.duration.observe(time.Since(start).Seconds(), method)
+			m.requestSize.observe(float64(len(req.Body)))
+			m.responseSize.observe(float64(w.BytesWritten()))
+		}
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. Mount it at
+// /metrics
+func (m *Metrics) Handler(w *response.Writer, req *request.Request) {
+	var body bytes.Buffer
+	_ = m.WriteText(&body)
+	h := response.GetDefaultHeaders(body.Len())
+	h.Set("Content-Type", ContentType)
+	h.Set("Cache-Control", "no-store")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if req.RequestLine.Method != request.MethodHead {
+		_, _ = w.WriteBody(body.Bytes())
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text format
+func (m *Metrics) WriteText(out io.Writer) error {
+	return writeFamilies(out, m.families)
+}
+
+func (m *Metrics) ConnOpened() {
+	m.openConns.add(1)
+	m.connsTotal.add(1)
+}
+
+func (m *Metrics) ConnClosed() {
+	m.openConns.add(-1)
+}
+
+func (m *Metrics) ParseError(err error) {
+	m.parseErrors.add(1, errorType(err))
+}
+
+// methodLabel folds unregistered methods together, so clients cannot make
+// up methods to grow the number of series without bound
+func methodLabel(method request.Method) string {
+	if request.IsKnownMethod(method) {
+		return string(method)
+	}
+	return "other"
+}
+
+// parseErrorTypes names the parse errors worth telling apart, most
+// specific first
+var parseErrorTypes = []struct {
+	err  error
+	name string
+}{
+	{request.ErrHeaderTooLarge, "header_too_large"},
+	{request.ErrUnsupportedMethod, "invalid_method"},
+	{request.ErrInvalidTarget, "invalid_target"},
+	{request.ErrProtocolVersion, "unsupported_version"},
+	{request.ErrMalformedRequest, "malformed_request_line"},
+	{headers.ErrObsFold, "obs_fold"},
+	{headers.ErrInvalidValue, "invalid_header_value"},
+	{headers.ErrMalformedHeader, "malformed_header"},
+	{request.ErrInvalidHost, "invalid_host"},
+	{request.ErrConflictingFraming, "conflicting_framing"},
+	{request.ErrDuplicateContentLength, "duplicate_content_length"},
+	{request.ErrIncorrectContextLength, "invalid_content_length"},
+	{request.ErrContextLengthExceeded, "body_too_long"},
+	{request.ErrContextSmall, "body_too_short"},
+	{request.ErrBodyTooLarge, "body_too_large"},
+	{request.ErrInvalidTransferEncoding, "invalid_transfer_encoding"},
+	{request.ErrUnsupportedTransferEncoding, "unsupported_transfer_encoding"},
+	{request.ErrMalformedChunk, "malformed_chunk"},
+	{request.ErrForbiddenTrailer, "forbidden_trailer"},
+	{io.ErrUnexpectedEOF, "unexpected_eof"},
+}
+
+func errorType(err error) string {
+	for _, t := range parseErrorTypes {
+		if errors.Is(err, t.err) {
+			return t.name
+		}
+	}
+	return "other"
+}
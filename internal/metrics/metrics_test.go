@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func text(t *testing.T, m *Metrics) string {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, m.WriteText(&out))
+	return out.String()
+}
+
+func TestExposition(t *testing.T) {
+	f := newFamily("test_seconds", "Help with \\ and\nnewline.", typeHistogram, []float64{0.1, 1})
+	f.observe(0.05)
+	f.observe(0.1)
+	f.observe(0.5)
+	f.observe(3)
+	c := newFamily("test_total", "Things.", typeCounter, nil, "kind")
+	c.add(2, `say "hi"`+"\n")
+	c.add(1, "a")
+
+	var out bytes.Buffer
+	require.NoError(t, writeFamilies(&out, []*family{f, c}))
+
+	// Test: Histogram buckets are cumulative and inclusive, and help and
+	// label values are escaped
+	assert.Equal(t, `# HELP test_seconds Help with \\ and\nnewline.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+# HELP test_total Things.
+# TYPE test_total counter
+test_total{kind="a"} 1
+test_total{kind="say \"hi\"\n"} 2
+`, out.String())
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(Options{})
+	var inFlight string
+	h := m.Middleware()(func(w *response.Writer, req *request.Request) {
+		inFlight = text(t, m)
+		_ = w.WriteError(response.StatusBadRequest, nil)
+	})
+
+	for _, method := range []string{"GET", "GET", "BREW"} {
+		req, err := request.RequestFromReader(strings.NewReader(method + " / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc"))
+		require.NoError(t, err)
+		h(response.NewWriter(io.Discard), req)
+	}
+	out := text(t, m)
+
+	// Test: Requests are counted by method and status, with unknown
+	// methods folded together
+	assert.Contains(t, out, `http_requests_total{method="GET",status="400"} 2`)
+	assert.Contains(t, out, `http_requests_total{method="other",status="400"} 1`)
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET"} 2`)
+
+	// Test: Body sizes land in their buckets
+	assert.Contains(t, out, `http_request_size_bytes_bucket{le="64"} 3`)
+	assert.Contains(t, out, "http_request_size_bytes_sum 9\n")
+	assert.Contains(t, out, "http_response_size_bytes_sum 48\n")
+
+	// Test: In-flight requests are counted while the handler runs
+	assert.Contains(t, inFlight, "http_requests_in_flight 1\n")
+	assert.Contains(t, out, "http_requests_in_flight 0\n")
+}
+
+func TestServer(t *testing.T) {
+	m := New(Options{})
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/metrics" {
+			m.Handler(w, req)
+			return
+		}
+		_ = w.WriteError(response.StatusOK, nil)
+	}
+	s, err := server.Serve(0, server.Chain(handler, m.Middleware()), server.WithObserver(m))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	do := func(raw string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+	do("GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	do("GET / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n")
+	do("GET / HTTP/1.1\r\n Host: x\r\n\r\n")
+	// Rejected connections close once the server has drained them, just
+	// after the client hangs up
+	require.Eventually(t, func() bool {
+		return strings.Contains(text(t, m), "http_open_connections 0\n")
+	}, 5*time.Second, time.Millisecond)
+
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(
+		do("GET /metrics HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	out := string(body)
+
+	// Test: The endpoint speaks the exposition format, and the server
+	// reports connections and parse errors by type
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, out, `http_requests_total{method="GET",status="200"} 1`)
+	assert.Contains(t, out, `http_parse_errors_total{type="duplicate_content_length"} 1`)
+	assert.Contains(t, out, `http_parse_errors_total{type="obs_fold"} 1`)
+	assert.Contains(t, out, "http_connections_total 4\n")
+	assert.Contains(t, out, "http_open_connections 1\n")
+	assert.Contains(t, out, "http_requests_in_flight 1\n")
+}
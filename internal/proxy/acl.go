@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// rules is one side of the destination allow/deny list
+type rules struct {
+	hosts    map[string]struct{}
+	suffixes []string
+	nets     []*net.IPNet
+}
+
+// parseRules accepts host names, "*.example.com" wildcards, IP addresses
+// and CIDR blocks
+func parseRules(entries []string) (rules, error) {
+	r := rules{hosts: make(map[string]struct{})}
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+			continue
+		case strings.Contains(e, "/"):
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return r, fmt.Errorf("proxy rule %q: %w", e, err)
+			}
+			r.nets = append(r.nets, n)
+		case net.ParseIP(e) != nil:
+			ip := net.ParseIP(e)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(e, "*."):
+			r.suffixes = append(r.suffixes, e[1:])
+		default:
+			r.hosts[e] = struct{}{}
+		}
+	}
+	return r, nil
+}
+
+func (r rules) empty() bool {
+	return len(r.hosts) == 0 && len(r.suffixes) == 0 && len(r.nets) == 0
+}
+
+func (r rules) matchHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, ok := r.hosts[host]; ok {
+		return true
+	}
+	for _, s := range r.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) matchIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
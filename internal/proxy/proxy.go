@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var (
+	ErrDestinationDenied = errors.New("destination not allowed by proxy rules")
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+// hopByHop headers describe a single connection and are never forwarded
+var hopByHop = []string{
+	"connection", "proxy-connection", "keep-alive", "proxy-authenticate",
+	"proxy-authorization", "te", "trailer", "transfer-encoding", "upgrade",
+}
+
+type Config struct {
+	// Allow, when non-empty, lists the only destinations the proxy may
+	// reach. Entries are host names, "*.suffix" wildcards, IPs or CIDRs
+	Allow []string
+	// Deny lists destinations that are always refused. It wins over Allow
+	Deny []string
+	// Authenticate checks Proxy-Authorization basic credentials. Nil
+	// disables proxy authentication
+	Authenticate func(user, pass string) bool
+	// Realm is sent in the Proxy-Authenticate challenge
+	Realm string
+	// DialTimeout bounds connecting to a destination. Zero means 10s
+	DialTimeout time.Duration
+	// Next serves origin-form requests addressed to the server itself.
+	// Without it they are answered with 400
+	Next func(w *response.Writer, req *request.Request)
+}
+
+// Proxy is a forward proxy handler. Run it on a server created with
+// server.WithProxyMode so absolute-form and CONNECT targets get through
+// the parser
+type Proxy struct {
+	cfg    Config
+	allow  rules
+	deny   rules
+	dialer net.Dialer
+}
+
+func New(cfg Config) (*Proxy, error) {
+	allow, err := parseRules(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseRules(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "proxy"
+	}
+
+	p := &Proxy{cfg: cfg, allow: allow, deny: deny}
+	p.dialer = net.Dialer{Timeout: cfg.DialTimeout}
+	return p, nil
+}
+
+// Handle is a server.Handler
+func (p *Proxy) Handle(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	isConnect := req.RequestLine.Method == request.MethodConnect
+
+	if !isConnect && strings.HasPrefix(target, "/") {
+		if p.cfg.Next != nil {
+			p.cfg.Next(w, req)
+			return
+		}
+		_ = w.WriteError(response.StatusBadRequest, nil)
+		return
+	}
+
+	if !p.authorized(req) {
+		h := response.Headers{}
+		h.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.cfg.Realm))
+		_ = w.WriteError(response.StatusProxyAuthRequired, h)
+		return
+	}
+
+	if isConnect {
+		p.tunnel(w, target)
+		return
+	}
+	p.forward(w, req)
+}
+
+// tunnel answers CONNECT by dialing the destination and splicing bytes
+// both ways until either side hangs up
+func (p *Proxy) tunnel(w *response.Writer, authority string) {
+	// Without the raw connection there is nothing to splice, so refuse
+	// before a 200 promises a tunnel
+	if !w.CanHijack() {
+		_ = w.WriteError(response.StatusNotImplemented, nil)
+		return
+	}
+	host, port, _ := net.SplitHostPort(authority)
+
+	upstream, err := p.dial(host, port)
+	if err != nil {
+		p.writeDialError(w, err)
+		return
+	}
+	defer upstream.Close()
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(response.Headers{}); err != nil {
+		return
+	}
+
+	client, pending, err := w.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if len(pending) > 0 {
+		if _, err := upstream.Write(pending); err != nil {
+			return
+		}
+	}
+	splice(client, upstream)
+}
+
+// forward relays an absolute-form request to its origin and streams the
+// reply back. The upstream connection is not reused, so the client
+// connection closes once the response is through
+func (p *Proxy) forward(w *response.Writer, req *request.Request) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		_ = w.WriteError(response.StatusBadRequest, nil)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	upstream, err := p.dial(u.Hostname(), port)
+	if err != nil {
+		p.writeDialError(w, err)
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write(outboundRequest(req, u)); err != nil {
+		_ = w.WriteError(response.StatusBadGateway, nil)
+		return
+	}
+
+	client, _, err := w.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	_, _ = io.Copy(client, upstream)
+}
+
+// outboundRequest rewrites req into origin-form without hop-by-hop headers
+func outboundRequest(req *request.Request, u *url.URL) []byte {
+	h := response.Headers{}
+	for k, v := range req.Headers {
+		h[k] = v
+	}
+	for _, name := range strings.Split(req.Headers.Get("Connection"), ",") {
+		delete(h, strings.ToLower(strings.TrimSpace(name)))
+	}
+	for _, name := range hopByHop {
+		delete(h, name)
+	}
+	h.Set("Host", u.Host)
+	h.Set("Connection", "close")
+	delete(h, "content-length")
+	if len(req.Body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.RequestLine.Method, u.RequestURI())
+	_ = response.WriteHeaders(&buf, h)
+	buf.Write(req.Body)
+	return buf.Bytes()
+}
+
+func (p *Proxy) authorized(req *request.Request) bool {
+	if p.cfg.Authenticate == nil {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	return ok && p.cfg.Authenticate(user, pass)
+}
+
+// dial connects to host:port. Host rules are checked up front; IP rules
+// are checked against the resolved address right before connecting so a
+// name cannot be used to sneak past a CIDR rule
+func (p *Proxy) dial(host, port string) (net.Conn, error) {
+	if p.deny.matchHost(host) {
+		return nil, ErrDestinationDenied
+	}
+
+	d := p.dialer
+	d.Control = func(network, address string, _ syscall.RawConn) error {
+		ipStr, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if !p.permitted(host, net.ParseIP(ipStr)) {
+			return ErrDestinationDenied
+		}
+		return nil
+	}
+	return d.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+func (p *Proxy) permitted(host string, ip net.IP) bool {
+	if p.deny.matchHost(host) || p.deny.matchIP(ip) {
+		return false
+	}
+	if p.allow.empty() {
+		return true
+	}
+	return p.allow.matchHost(host) || p.allow.matchIP(ip)
+}
+
+func (p *Proxy) writeDialError(w *response.Writer, err error) {
+	if errors.Is(err, ErrDestinationDenied) {
+		_ = w.WriteError(response.StatusForbidden, nil)
+		return
+	}
+	_ = w.WriteError(response.StatusBadGateway, nil)
+}
+
+// splice copies in both directions, half-closing each side as its source
+// finishes so protocols that rely on EOF keep working
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/http2"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startProxy runs a proxy server on a random local port
+func startProxy(t *testing.T, cfg Config) string {
+	t.Helper()
+	p, err := New(cfg)
+	require.NoError(t, err)
+	srv, err := server.Serve(0, p.Handle, server.WithProxyMode())
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+// startEcho runs a TCP listener that echoes every connection back
+func startEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// roundTrip sends raw to the proxy and returns the status line plus a
+// reader positioned after the response headers
+func roundTrip(t *testing.T, proxyAddr, raw string) (string, net.Conn, *bufio.Reader) {
+	status, _, conn, br := roundTripHeaders(t, proxyAddr, raw)
+	return status, conn, br
+}
+
+func roundTripHeaders(t *testing.T, proxyAddr, raw string) (string, string, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	var headers strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		headers.WriteString(line)
+	}
+	return strings.TrimSpace(status), headers.String(), conn, br
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echo := startEcho(t)
+	proxy := startProxy(t, Config{})
+
+	// Test: Bytes sent with the CONNECT request are forwarded too
+	status, conn, br := roundTrip(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\nearly ")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	got := make([]byte, len("early ping"))
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "early ping", string(got))
+}
+
+func TestConnectOverH2C(t *testing.T) {
+	echo := startEcho(t)
+	p, err := New(Config{})
+	require.NoError(t, err)
+	srv, err := server.Serve(0, p.Handle, server.WithProxyMode(), server.WithH2C(http2.Config{}))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	block := http2.Encoder{}.Encode(nil, []http2.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":authority", Value: echo},
+	})
+	out := append([]byte(http2.ClientPreface), http2.AppendFrame(nil, http2.Frame{Type: http2.FrameSettings})...)
+	out = http2.AppendFrame(out, http2.Frame{
+		Type:     http2.FrameHeaders,
+		Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+		StreamID: 1,
+		Payload:  block,
+	})
+	_, err = conn.Write(out)
+	require.NoError(t, err)
+
+	// Test: A stream cannot be hijacked, so CONNECT is refused rather than
+	// answered with a 200 that has no tunnel behind it
+	br := bufio.NewReader(conn)
+	for {
+		f, err := http2.ReadFrame(br, 1<<14)
+		require.NoError(t, err)
+		if f.Type == http2.FrameHeaders && f.StreamID == 1 {
+			fields, err := http2.NewDecoder(4096).Decode(f.Payload)
+			require.NoError(t, err)
+			require.NotEmpty(t, fields)
+			assert.Equal(t, http2.HeaderField{Name: ":status", Value: "501"}, fields[0])
+			return
+		}
+	}
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	origin, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RequestLine.RequestTarget + " " + req.Headers.Get("Proxy-Authorization") + string(req.Body))
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody(body)
+	})
+	require.NoError(t, err)
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Addr().String())
+	originURL := "http://127.0.0.1:" + port
+
+	proxy := startProxy(t, Config{})
+
+	// Test: Request is rewritten to origin-form and proxy headers stripped
+	status, _, br := roundTrip(t, proxy, "POST "+originURL+"/coffee?x=1 HTTP/1.1\r\n"+
+		"Host: 127.0.0.1\r\nProxy-Authorization: Basic secret\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	body, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee?x=1 hello", string(body))
+}
+
+func TestDestinationRules(t *testing.T) {
+	echo := startEcho(t)
+
+	// Test: Deny list by CIDR
+	proxy := startProxy(t, Config{Deny: []string{"127.0.0.0/8"}})
+	status, _, _ := roundTrip(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", status)
+
+	// Test: Name that resolves into a denied range is caught at dial time
+	_, port, _ := net.SplitHostPort(echo)
+	status, _, _ = roundTrip(t, proxy, "CONNECT localhost:"+port+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", status)
+
+	// Test: Destination outside the allow list
+	proxy = startProxy(t, Config{Allow: []string{"*.example.com"}})
+	status, _, _ = roundTrip(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", status)
+
+	// Test: Destination inside the allow list
+	proxy = startProxy(t, Config{Allow: []string{"127.0.0.1"}})
+	status, _, _ = roundTrip(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+
+	// Test: Bad CIDR is a config error
+	_, err := New(Config{Deny: []string{"10.0.0.0/99"}})
+	require.Error(t, err)
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	echo := startEcho(t)
+	proxy := startProxy(t, Config{
+		Authenticate: func(user, pass string) bool { return user == "lane" && pass == "go" },
+		Realm:        "office",
+	})
+
+	// Test: Missing credentials get a challenge
+	status, headers, _, _ := roundTripHeaders(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required", status)
+	assert.Contains(t, headers, "proxy-authenticate: Basic realm=\"office\"\r\n")
+
+	// Test: Valid credentials open the tunnel
+	creds := base64.StdEncoding.EncodeToString([]byte("lane:go"))
+	status, _, _ = roundTrip(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\nProxy-Authorization: Basic "+creds+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+}
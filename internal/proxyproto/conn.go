@@ -0,0 +1,180 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+)
+
+const defaultTimeout = 5 * time.Second
+
+type Options struct {
+	// Trusted lists the load balancers allowed to send a header.
+	// Connections from anywhere else are passed through untouched, so a
+	// client cannot claim whatever address it likes. Empty trusts every
+	// peer, for listeners only a load balancer can reach
+	Trusted []netip.Prefix
+	// Timeout bounds reading the header. Defaults to 5s
+	Timeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	return o
+}
+
+// Listener wraps connections from trusted sources in a Conn
+type Listener struct {
+	net.Listener
+	opts Options
+}
+
+// NewListener expects every trusted connection to start with a PROXY
+// header. Put it beneath any TLS listener, since the header comes before
+// the handshake
+func NewListener(l net.Listener, opts Options) *Listener {
+	return &Listener{Listener: l, opts: opts.withDefaults()}
+}
+
+// Accept does not wait for the header, so one slow client cannot hold up
+// the others
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, timeout: l.opts.Timeout}, nil
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	if len(l.opts.Trusted) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range l.opts.Trusted {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn reads the PROXY header the first time it is read from or asked for
+// its addresses, and reports the addresses the header carried
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	header *Header
+	err    error
+
+	// mu guards readDeadline, the deadline the caller asked for, which is
+	// put back once the header has been read under the timeout
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := time.Now().Add(c.timeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		_ = c.Conn.SetReadDeadline(deadline)
+		c.mu.Unlock()
+
+		c.reader = bufio.NewReader(c.Conn)
+		c.header, c.err = ReadHeader(c.reader)
+
+		c.mu.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	})
+}
+
+// Header returns the parsed header, waiting for it if need be
+func (c *Conn) Header() (*Header, error) {
+	c.init()
+	return c.header, c.err
+}
+
+// Read fails with the header's error if it could not be read
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr is the original client, or the peer if the header did not
+// name one
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Source)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to, or ours if the header
+// did not name one
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination.IsValid() {
+		return net.TCPAddrFromAddrPort(c.header.Destination)
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+type headerKey struct{}
+
+// SetHeader records the PROXY header of the connection req arrived on
+func SetHeader(req *request.Request, h *Header) {
+	req.SetValue(headerKey{}, h)
+}
+
+// HeaderFrom returns the PROXY header the server attached to req, for
+// reading TLVs such as TypeUniqueID
+func HeaderFrom(req *request.Request) (*Header, bool) {
+	h, ok := req.Value(headerKey{}).(*Header)
+	return h, ok
+}
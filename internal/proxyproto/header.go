@@ -0,0 +1,253 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader = errors.New("proxyproto: connection did not start with a PROXY header")
+	ErrInvalid  = errors.New("proxyproto: malformed PROXY header")
+)
+
+// Command says whether a v2 header carries a proxied client. LOCAL is sent
+// by the load balancer for its own connections, such as health checks
+type Command byte
+
+const (
+	Local Command = 0x0
+	Proxy Command = 0x1
+)
+
+// TLV types defined by the PROXY protocol spec
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// TLV is a type-length-value extension from a v2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header
+type Header struct {
+	Version int
+	Command Command
+	// Source is the original client and Destination the address it
+	// connected to. Both are invalid for LOCAL, v1 UNKNOWN and non-IP
+	// families, in which case the connection's own addresses stand
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	TLVs        []TLV
+}
+
+// TLV returns the value of the first TLV of type typ
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, t := range h.TLVs {
+		if t.Type == typ {
+			return t.Value, true
+		}
+	}
+	return nil, false
+}
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// v1MaxLen is the longest v1 line, CRLF included
+	v1MaxLen = 107
+	// v2HeaderLen is the signature, version/command, family and length
+	v2HeaderLen = 16
+)
+
+// ReadHeader reads a v1 or v2 header from the start of r. Bytes after it
+// are left in r
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		b, err := r.Peek(v2HeaderLen)
+		if err != nil || !bytes.Equal(b[:len(v2Signature)], v2Signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n" and the UNKNOWN form
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLen)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == v1MaxLen {
+			return nil, fmt.Errorf("%w: v1 line too long", ErrInvalid)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line not terminated by CRLF", ErrInvalid)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1, Command: Proxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: v1 line has %d fields", ErrInvalid, len(fields))
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	switch fields[1] {
+	case "TCP4":
+		if !src.Addr().Is4() || !dst.Addr().Is4() {
+			return nil, fmt.Errorf("%w: TCP4 with non-IPv4 address", ErrInvalid)
+		}
+	case "TCP6":
+		if !src.Addr().Is6() || !dst.Addr().Is6() {
+			return nil, fmt.Errorf("%w: TCP6 with non-IPv6 address", ErrInvalid)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown v1 protocol %q", ErrInvalid, fields[1])
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad address %q", ErrInvalid, ip)
+	}
+	// The spec forbids leading zeros
+	if port == "" || (port[0] == '0' && port != "0") {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad port %q", ErrInvalid, port)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad port %q", ErrInvalid, port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	inetLen  = 12
+	inet6Len = 36
+	unixLen  = 216
+)
+
+// readV2 parses the binary header: signature, version and command, address
+// family, payload length, then addresses and TLVs
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if version := fixed[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalid, version)
+	}
+	cmd := Command(fixed[12] & 0x0F)
+	if cmd != Local && cmd != Proxy {
+		return nil, fmt.Errorf("%w: command %#x", ErrInvalid, byte(cmd))
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2, Command: cmd}
+	// LOCAL addresses mean nothing, so they and any TLVs are skipped
+	if cmd == Local {
+		return h, nil
+	}
+
+	var addrLen int
+	switch fixed[13] >> 4 {
+	case familyUnspec:
+	case familyInet:
+		addrLen = inetLen
+	case familyInet6:
+		addrLen = inet6Len
+	case familyUnix:
+		addrLen = unixLen
+	default:
+		return nil, fmt.Errorf("%w: address family %#x", ErrInvalid, fixed[13]>>4)
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("%w: %d bytes is too short for the addresses", ErrInvalid, len(payload))
+	}
+
+	a := payload[:addrLen]
+	switch addrLen {
+	case inetLen:
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(a[0:4])), binary.BigEndian.Uint16(a[8:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(a[4:8])), binary.BigEndian.Uint16(a[10:]))
+	case inet6Len:
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(a[0:16])), binary.BigEndian.Uint16(a[32:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(a[16:32])), binary.BigEndian.Uint16(a[34:]))
+	}
+
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalid)
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("%w: TLV %#x overruns the header", ErrInvalid, b[0])
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
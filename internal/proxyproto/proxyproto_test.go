@@ -0,0 +1,200 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func read(raw string) (*Header, string, error) {
+	r := bufio.NewReader(strings.NewReader(raw))
+	h, err := ReadHeader(r)
+	rest, _ := io.ReadAll(r)
+	return h, string(rest), err
+}
+
+func TestV1(t *testing.T) {
+	// Test: TCP4 addresses are read and the rest of the stream is left
+	h, rest, err := read("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\nGET / HTTP/1.1\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, Proxy, h.Command)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:51000"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("198.51.100.2:443"), h.Destination)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	h, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 4711 80\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:4711"), h.Source)
+
+	// Test: UNKNOWN carries no addresses
+	h, _, err = read("PROXY UNKNOWN ffff:f...f:ffff 1.2.3.4 65535 65535\r\n")
+	require.NoError(t, err)
+	assert.False(t, h.Source.IsValid())
+
+	// Test: Malformed lines are rejected
+	for _, raw := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 51000\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 051000 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 70000 443\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	} {
+		_, _, err := read(raw)
+		assert.ErrorIs(t, err, ErrInvalid, raw)
+	}
+
+	// Test: A plain request is not a header
+	_, _, err = read("POST / HTTP/1.1\r\n")
+	assert.ErrorIs(t, err, ErrNoHeader)
+}
+
+// v2 builds a binary header
+func v2(cmd Command, family byte, addrs []byte, tlvs ...TLV) []byte {
+	payload := append([]byte{}, addrs...)
+	for _, t := range tlvs {
+		payload = append(payload, t.Type, 0, 0)
+		binary.BigEndian.PutUint16(payload[len(payload)-2:], uint16(len(t.Value)))
+		payload = append(payload, t.Value...)
+	}
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|byte(cmd), family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestV2(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xC7, 0x38, 0x01, 0xBB}
+
+	// Test: IPv4 addresses and TLVs are read
+	raw := v2(Proxy, 0x11, inet,
+		TLV{Type: TypeALPN, Value: []byte("h2")},
+		TLV{Type: TypeUniqueID, Value: []byte("conn-42")},
+	)
+	h, rest, err := read(string(raw) + "GET /")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:51000"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("198.51.100.2:443"), h.Destination)
+	id, ok := h.TLV(TypeUniqueID)
+	require.True(t, ok)
+	assert.Equal(t, "conn-42", string(id))
+	_, ok = h.TLV(TypeSSL)
+	assert.False(t, ok)
+	assert.Equal(t, "GET /", rest)
+
+	// Test: IPv6
+	inet6 := make([]byte, inet6Len)
+	copy(inet6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	copy(inet6[16:], netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.BigEndian.PutUint16(inet6[32:], 4711)
+	binary.BigEndian.PutUint16(inet6[34:], 443)
+	h, _, err = read(string(v2(Proxy, 0x21, inet6)))
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:4711"), h.Source)
+
+	// Test: LOCAL and unspecified families keep the connection's addresses
+	h, rest, err = read(string(v2(Local, 0x11, inet)) + "x")
+	require.NoError(t, err)
+	assert.Equal(t, Local, h.Command)
+	assert.False(t, h.Source.IsValid())
+	assert.Equal(t, "x", rest)
+	h, _, err = read(string(v2(Proxy, 0x00, nil)))
+	require.NoError(t, err)
+	assert.False(t, h.Source.IsValid())
+
+	// Test: Bad versions, commands, short addresses and overrunning TLVs
+	// are rejected
+	bad := v2(Proxy, 0x11, inet)
+	bad[12] = 0x11
+	_, _, err = read(string(bad))
+	assert.ErrorIs(t, err, ErrInvalid)
+	bad[12] = 0x2F
+	_, _, err = read(string(bad))
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, _, err = read(string(v2(Proxy, 0x11, inet[:8])))
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, _, err = read(string(v2(Proxy, 0x11, append(inet, TypeNoop, 0, 9, 1))))
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	// Test: A truncated payload is an I/O error
+	_, _, err = read(string(raw[:len(raw)-2]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// listen accepts one connection through a Listener and returns both ends
+func listen(t *testing.T, opts Options) (client net.Conn, server net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewListener(inner, opts)
+	t.Cleanup(func() { l.Close() })
+
+	client, err = net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	server, err = l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestListener(t *testing.T) {
+	// Test: A trusted peer's header replaces the addresses and the data
+	// after it reads as normal
+	client, server := listen(t, Options{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	_, err := client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:51000", server.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.2:443", server.LocalAddr().String())
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(server, buf[:5])
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:5]))
+
+	// Test: Untrusted peers are passed through, header and all
+	client, server = listen(t, Options{Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	_, ok := server.(*Conn)
+	assert.False(t, ok)
+	_, err = client.Write([]byte("PROXY "))
+	require.NoError(t, err)
+	_, err = io.ReadFull(server, buf[:6])
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY ", string(buf[:6]))
+
+	// Test: A trusted peer without a header cannot read
+	client, server = listen(t, Options{})
+	_, err = client.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	_, err = server.Read(buf)
+	assert.ErrorIs(t, err, ErrNoHeader)
+	assert.Equal(t, client.LocalAddr().String(), server.RemoteAddr().String())
+}
+
+func TestListenerTimeout(t *testing.T) {
+	// Test: A peer that never sends its header times out
+	_, server := listen(t, Options{Timeout: 20 * time.Millisecond})
+	start := time.Now()
+	_, err := server.(*Conn).Header()
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: The caller's own deadline outlives the header read
+	client, server := listen(t, Options{})
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = client.Write([]byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	_, err = server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of a single Allow call
+type Decision struct {
+	Allowed bool
+	// Limit is the quota for the window
+	Limit int
+	// Remaining is what is left of the quota after this request
+	Remaining int
+	// Reset is how long until the quota is fully available again
+	Reset time.Duration
+	// RetryAfter is how long a rejected client should wait. It is zero
+	// when the request was allowed
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the client identified by key may make a request
+type Limiter interface {
+	Allow(key string, now time.Time) Decision
+	// Policy describes the quota for the RateLimit-Policy header
+	Policy() (limit int, window time.Duration)
+}
+
+// defaultMaxKeys bounds how many clients a limiter tracks
+const defaultMaxKeys = 10000
+
+// checkPolicy catches a quota that could never work when the limiter is
+// built, rather than on the first request, the way time.NewTicker does
+func checkPolicy(fn string, limit int, window time.Duration) {
+	if limit <= 0 || window <= 0 {
+		panic(fmt.Sprintf("ratelimit: %s needs a positive limit and window, got %d per %v", fn, limit, window))
+	}
+}
+
+// TokenBucket allows bursts of up to Limit requests and refills at Limit per
+// Window
+type TokenBucket struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	buckets *store[bucket]
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket tracks at most maxKeys clients. Zero means 10000. It
+// panics unless limit and window are positive
+func NewTokenBucket(limit int, window time.Duration, maxKeys int) *TokenBucket {
+	checkPolicy("NewTokenBucket", limit, window)
+	if maxKeys == 0 {
+		maxKeys = defaultMaxKeys
+	}
+	return &TokenBucket{limit: limit, window: window, buckets: newStore[bucket](maxKeys)}
+}
+
+func (tb *TokenBucket) Policy() (int, time.Duration) {
+	return tb.limit, tb.window
+}
+
+func (tb *TokenBucket) Allow(key string, now time.Time) Decision {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b := tb.buckets.get(key, func() bucket {
+		return bucket{tokens: float64(tb.limit), last: now}
+	})
+	perToken := tb.window / time.Duration(tb.limit)
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(tb.limit), b.tokens+float64(elapsed)/float64(perToken))
+		b.last = now
+	}
+
+	d := Decision{Limit: tb.limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = time.Duration((float64(tb.limit) - b.tokens) * float64(perToken))
+	return d
+}
+
+// SlidingWindow allows Limit requests in any Window. It keeps a count for
+// the current and previous fixed windows and weights the previous one by
+// how much of it still overlaps, which avoids the burst at the boundary of
+// a plain fixed window without storing every timestamp
+type SlidingWindow struct {
+	limit  int
+	window time.Duration
+
+	mu       sync.Mutex
+	counters *store[counter]
+}
+
+type counter struct {
+	start time.Time
+	curr  int
+	prev  int
+}
+
+// NewSlidingWindow tracks at most maxKeys clients. Zero means 10000. It
+// panics unless limit and window are positive
+func NewSlidingWindow(limit int, window time.Duration, maxKeys int) *SlidingWindow {
+	checkPolicy("NewSlidingWindow", limit, window)
+	if maxKeys == 0 {
+		maxKeys = defaultMaxKeys
+	}
+	return &SlidingWindow{limit: limit, window: window, counters: newStore[counter](maxKeys)}
+}
+
+func (sw *SlidingWindow) Policy() (int, time.Duration) {
+	return sw.limit, sw.window
+}
+
+func (sw *SlidingWindow) Allow(key string, now time.Time) Decision {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	start := now.Truncate(sw.window)
+	c := sw.counters.get(key, func() counter { return counter{start: start} })
+	switch {
+	case start.Equal(c.start):
+	case start.Sub(c.start) == sw.window:
+		c.prev, c.curr, c.start = c.curr, 0, start
+	default:
+		// A whole window or more went by with no requests
+		c.prev, c.curr, c.start = 0, 0, start
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(sw.window)
+	estimate := float64(c.prev)*weight + float64(c.curr)
+
+	d := Decision{Limit: sw.limit, Reset: sw.window - elapsed}
+	if estimate+1 <= float64(sw.limit) {
+		c.curr++
+		estimate++
+		d.Allowed = true
+	} else {
+		d.RetryAfter = sw.retryAfter(c, elapsed)
+	}
+	d.Remaining = max(sw.limit-int(math.Ceil(estimate)), 0)
+	return d
+}
+
+// retryAfter works out when the weighted count will have room for one more
+// request
+func (sw *SlidingWindow) retryAfter(c *counter, elapsed time.Duration) time.Duration {
+	room := float64(sw.limit - 1)
+	if c.curr <= sw.limit-1 {
+		// Wait for enough of the previous window to slide out
+		need := 1 - (room-float64(c.curr))/float64(c.prev)
+		return max(time.Duration(need*float64(sw.window))-elapsed, 0)
+	}
+	// The current window is full by itself, so wait for it to become the
+	// previous one and slide out far enough
+	need := 1 - room/float64(c.curr)
+	return sw.window - elapsed + time.Duration(need*float64(sw.window))
+}
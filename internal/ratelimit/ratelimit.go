@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+// KeyFunc names the client a request counts against
+type KeyFunc func(req *request.Request) string
+
+// ByRemoteAddr keys on the client's IP, which is Request.ClientIP when the
+// server resolved one through trusted proxies and the peer's otherwise.
+// IPv6 addresses are grouped by /64, since a single client usually holds
+// the whole prefix
+func ByRemoteAddr(req *request.Request) string {
+	host := req.ClientIP
+	if host == "" {
+		var err error
+		if host, _, err = net.SplitHostPort(req.RemoteAddr); err != nil {
+			host = req.RemoteAddr
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "ip:" + host
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return "ip:" + ip.String()
+}
+
+// ByHeader keys on a request header such as an API key. Requests without it
+// fall back to ByRemoteAddr, so leaving the header out is no way around the
+// limit
+func ByHeader(name string) KeyFunc {
+	return func(req *request.Request) string {
+		if v := req.Headers.Get(name); v != "" {
+			return "header:" + v
+		}
+		return ByRemoteAddr(req)
+	}
+}
+
+// ByUser keys on the authenticated user, falling back to ByRemoteAddr for
+// anonymous requests. Put it after the auth middleware in the chain
+func ByUser(req *request.Request) string {
+	if user := req.User(); user != "" {
+		return "user:" + user
+	}
+	return ByRemoteAddr(req)
+}
+
+type Options struct {
+	Limiter Limiter
+	// Key defaults to ByRemoteAddr
+	Key KeyFunc
+}
+
+// New returns middleware that answers clients over their quota with 429
+// and Retry-After. Every response carries RateLimit-Policy, RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset so clients can pace themselves
+func New(opts Options) server.Middleware {
+	if opts.Key == nil {
+		opts.Key = ByRemoteAddr
+	}
+	limit, window := opts.Limiter.Policy()
+	policy := fmt.Sprintf("%d;w=%d", limit, seconds(window))
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			d := opts.Limiter.Allow(opts.Key(req), time.Now())
+			if !d.Allowed {
+				h := response.Headers{}
+				setHeaders(h, policy, d)
+				h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+				_ = w.WriteError(response.StatusTooManyRequests, h)
+				return
+			}
+			w.OnHeaders(func(_ response.StatusCode, h response.Headers) {
+				setHeaders(h, policy, d)
+			})
+			next(w, req)
+		}
+	}
+}
+
+func setHeaders(h response.Headers, policy string, d Decision) {
+	h.Set("RateLimit-Policy", policy)
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+}
+
+// seconds rounds up, so a client that waits as long as it was told is never
+// early
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
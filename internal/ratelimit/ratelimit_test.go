@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var t0 = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(3, 3*time.Second, 0)
+
+	// Test: A full bucket allows a burst up to the limit
+	for i := 2; i >= 0; i-- {
+		d := tb.Allow("a", t0)
+		require.True(t, d.Allowed)
+		assert.Equal(t, i, d.Remaining)
+	}
+	d := tb.Allow("a", t0)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, time.Second, d.RetryAfter)
+	assert.Equal(t, 3*time.Second, d.Reset)
+
+	// Test: Tokens refill at the steady rate
+	d = tb.Allow("a", t0.Add(500*time.Millisecond))
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+	assert.True(t, tb.Allow("a", t0.Add(time.Second)).Allowed)
+	assert.False(t, tb.Allow("a", t0.Add(time.Second)).Allowed)
+
+	// Test: Keys are independent and refills stop at the limit
+	assert.True(t, tb.Allow("b", t0).Allowed)
+	d = tb.Allow("a", t0.Add(time.Hour))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Remaining)
+}
+
+func TestLimiterPolicy(t *testing.T) {
+	// Test: A quota that can never work is refused at construction
+	for _, tc := range []struct {
+		limit  int
+		window time.Duration
+	}{{0, time.Minute}, {-1, time.Minute}, {1, 0}, {1, -time.Second}} {
+		assert.Panics(t, func() { NewTokenBucket(tc.limit, tc.window, 0) }, "%d per %v", tc.limit, tc.window)
+		assert.Panics(t, func() { NewSlidingWindow(tc.limit, tc.window, 0) }, "%d per %v", tc.limit, tc.window)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := NewSlidingWindow(4, 10*time.Second, 0)
+
+	// Test: The limit holds within a window
+	for range 4 {
+		require.True(t, sw.Allow("a", t0.Add(time.Second)).Allowed)
+	}
+	d := sw.Allow("a", t0.Add(time.Second))
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	assert.Equal(t, 9*time.Second, d.Reset)
+
+	// Test: Just after the boundary the previous window still counts, so
+	// there is no fresh burst of 4
+	d = sw.Allow("a", t0.Add(10*time.Second))
+	assert.False(t, d.Allowed)
+	// 4 previous requests weighted at 1 - e/10 must drop to 3: e = 2.5s
+	assert.Equal(t, 2500*time.Millisecond, d.RetryAfter)
+	assert.True(t, sw.Allow("a", t0.Add(12500*time.Millisecond)).Allowed)
+
+	// Test: A long gap clears both windows
+	for range 4 {
+		require.True(t, sw.Allow("a", t0.Add(time.Minute)).Allowed)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	tb := NewTokenBucket(1, time.Minute, 2)
+	assert.True(t, tb.Allow("a", t0).Allowed)
+	assert.True(t, tb.Allow("b", t0).Allowed)
+	assert.False(t, tb.Allow("a", t0).Allowed)
+
+	// Test: New keys push out the least recently used, keeping memory bounded
+	assert.True(t, tb.Allow("c", t0).Allowed)
+	assert.Equal(t, 2, tb.buckets.len())
+	assert.True(t, tb.Allow("b", t0).Allowed, "b was evicted and starts afresh")
+	assert.False(t, tb.Allow("c", t0).Allowed)
+}
+
+func TestKeys(t *testing.T) {
+	req := &request.Request{RemoteAddr: "203.0.113.7:51000", Headers: map[string]string{}}
+	assert.Equal(t, "ip:203.0.113.7", ByRemoteAddr(req))
+	req.RemoteAddr = "[2001:db8:1:2:aaaa::1]:443"
+	assert.Equal(t, "ip:2001:db8:1:2::", ByRemoteAddr(req))
+
+	// Test: Header and user keys fall back to the address
+	assert.Equal(t, "ip:2001:db8:1:2::", ByHeader("X-API-Key")(req))
+	req.Headers.Set("X-API-Key", "k-123")
+	assert.Equal(t, "header:k-123", ByHeader("X-API-Key")(req))
+	assert.Equal(t, "ip:2001:db8:1:2::", ByUser(req))
+	req.SetUser("ada")
+	assert.Equal(t, "user:ada", ByUser(req))
+
+	// Test: A client IP resolved through trusted proxies wins
+	req.ClientIP = "198.51.100.9"
+	assert.Equal(t, "ip:198.51.100.9", ByRemoteAddr(req))
+}
+
+func ok(w *response.Writer, req *request.Request) {
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+func get(t *testing.T, h server.Handler) *http.Response {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:4000"
+	var out bytes.Buffer
+	h(response.NewWriter(&out), req)
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestMiddleware(t *testing.T) {
+	h := New(Options{Limiter: NewTokenBucket(2, time.Minute, 0)})(ok)
+
+	// Test: Allowed responses carry the quota
+	resp := get(t, h)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "2;w=60", resp.Header.Get("RateLimit-Policy"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", resp.Header.Get("RateLimit-Reset"))
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+
+	// Test: Over the limit gets 429 with Retry-After
+	get(t, h)
+	resp = get(t, h)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import "container/list"
+
+// store holds per-key state up to a fixed number of keys, evicting the
+// least recently used one to make room. An evicted key starts afresh, which
+// errs towards letting a request through rather than growing without bound
+// when clients churn through addresses. It is not safe for concurrent use
+type store[V any] struct {
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type storeEntry[V any] struct {
+	key string
+	val V
+}
+
+func newStore[V any](max int) *store[V] {
+	return &store[V]{max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns the state for key, creating it with init if it is new
+func (s *store[V]) get(key string, init func() V) *V {
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		return &el.Value.(*storeEntry[V]).val
+	}
+	if s.ll.Len() >= s.max {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*storeEntry[V]).key)
+	}
+	e := &storeEntry[V]{key: key, val: init()}
+	s.items[key] = s.ll.PushFront(e)
+	return &e.val
+}
+
+func (s *store[V]) len() int {
+	return s.ll.Len()
+}
@@ -0,0 +1,245 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrConflictingFraming          = errors.New("both Transfer-Encoding and Content-Length are present")
+	ErrDuplicateContentLength      = errors.New("multiple Content-Length values")
+	ErrInvalidTransferEncoding     = errors.New("chunked must be the final transfer coding")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer coding")
+	ErrMalformedChunk              = errors.New("malformed chunked body")
+	ErrInvalidHost                 = errors.New("missing or duplicate Host header")
+	ErrForbiddenTrailer            = errors.New("framing header sent as a trailer")
+	ErrBodyTooLarge                = errors.New("request body exceeds the size limit")
+)
+
+// maxChunkSize caps a single chunk so the hex size can never overflow an int
+const maxChunkSize = 1<<31 - 1
+
+// resolveFraming decides how the body is delimited once the headers are in,
+// following the precedence rules of RFC 9112 6.3
+func (r *Request) resolveFraming() error {
+	if r.opts.Strict {
+		host, ok := r.Headers["host"]
+		if !ok || strings.Contains(host, ",") {
+			return ErrInvalidHost
+		}
+	}
+
+	clStr, hasCL := r.Headers["content-length"]
+
+	if te, hasTE := r.Headers["transfer-encoding"]; hasTE {
+		if hasCL {
+			if r.opts.Strict {
+				return ErrConflictingFraming
+			}
+			// Transfer-Encoding overrides Content-Length. Drop the stale
+			// value so nothing downstream trusts it, and do not reuse a
+			// connection that sent it (RFC 9112 6.3)
+			delete(r.Headers, "content-length")
+			r.closeAfter = true
+		}
+		if err := checkTransferEncoding(te); err != nil {
+			return err
+		}
+		r.Trailers = make(headers.Headers)
+		r.state = ParsingChunkSize
+		return nil
+	}
+
+	if !hasCL {
+		r.state = Done
+		return nil
+	}
+
+	contentLength, err := parseContentLength(clStr, r.opts.Strict)
+	if err != nil {
+		return err
+	}
+	r.contentLength = contentLength
+	if err := r.checkBodySize(contentLength); err != nil {
+		return err
+	}
+
+	if contentLength == 0 {
+		r.state = Done
+		return nil
+	}
+
+	r.state = ParsingBody
+	return nil
+}
+
+// checkBodySize fails as soon as the body is known to grow to size, before
+// any of it is buffered
+func (r *Request) checkBodySize(size int) error {
+	if r.opts.MaxBodySize > 0 && size > r.opts.MaxBodySize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBodyTooLarge, size, r.opts.MaxBodySize)
+	}
+	return nil
+}
+
+// checkTransferEncoding only accepts a lone "chunked" coding. Anything layered
+// underneath it is a coding we cannot decode
+func checkTransferEncoding(te string) error {
+	codings := strings.Split(te, ",")
+	for i, c := range codings {
+		codings[i] = strings.ToLower(strings.TrimSpace(c))
+	}
+
+	last := len(codings) - 1
+	if codings[last] != "chunked" {
+		return fmt.Errorf("%w: got %q", ErrInvalidTransferEncoding, te)
+	}
+	for _, c := range codings[:last] {
+		if c == "chunked" || c == "" {
+			return fmt.Errorf("%w: got %q", ErrInvalidTransferEncoding, te)
+		}
+	}
+	if last > 0 {
+		return fmt.Errorf("%w: got %q", ErrUnsupportedTransferEncoding, te)
+	}
+	return nil
+}
+
+// parseContentLength accepts only 1*DIGIT. Repeated headers arrive joined with
+// commas; strict mode rejects them outright, otherwise they must all agree
+func parseContentLength(value string, strict bool) (int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) > 1 && strict {
+		return 0, fmt.Errorf("%w: got %q", ErrDuplicateContentLength, value)
+	}
+
+	n := -1
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if !isDigits(p) {
+			return 0, ErrIncorrectContextLength
+		}
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, ErrIncorrectContextLength
+		}
+		if n != -1 && v != n {
+			return 0, fmt.Errorf("%w: got %q", ErrDuplicateContentLength, value)
+		}
+		n = v
+	}
+	return n, nil
+}
+
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.state {
+
+	case ParsingChunkSize:
+		lineEnd := bytes.Index(data, crlf)
+		if lineEnd == -1 {
+			return 0, nil
+		}
+
+		size, err := parseChunkSize(data[:lineEnd], r.opts.Strict)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := r.checkBodySize(len(r.Body) + size); err != nil {
+			return 0, err
+		}
+
+		if size == 0 {
+			r.state = ParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = ParsingChunkData
+		}
+		return lineEnd + 2, nil
+
+	case ParsingChunkData:
+		n := min(len(data), r.chunkRemaining)
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkRemaining -= n
+		if r.chunkRemaining == 0 {
+			r.state = ParsingChunkEnd
+		}
+		return n, nil
+
+	case ParsingChunkEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		// Chunk data must be followed by exactly CRLF, otherwise the chunk
+		// size and the data disagree about where the body ends
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("%w: chunk data not terminated by CRLF", ErrMalformedChunk)
+		}
+		r.state = ParsingChunkSize
+		return 2, nil
+
+	case ParsingTrailers:
+		consumed, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return consumed, err
+		}
+		if !done {
+			return consumed, nil
+		}
+
+		for _, name := range []string{"content-length", "transfer-encoding", "host"} {
+			if _, ok := r.Trailers[name]; !ok {
+				continue
+			}
+			if r.opts.Strict {
+				return consumed, fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+			}
+			delete(r.Trailers, name)
+		}
+
+		r.state = Done
+		return consumed, nil
+	}
+
+	return 0, nil
+}
+
+// parseChunkSize reads "chunk-size [ chunk-ext ]" and ignores the extensions
+func parseChunkSize(line []byte, strict bool) (int, error) {
+	if bytes.IndexByte(line, '\n') != -1 || bytes.IndexByte(line, '\r') != -1 {
+		return 0, fmt.Errorf("%w: bare CR or LF in chunk size line", ErrMalformedChunk)
+	}
+
+	sizeStr := line
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		sizeStr = line[:i]
+	}
+	// Whitespace before an extension is allowed (BWS), but strict mode
+	// does not let any through since parsers disagree on it
+	if !strict {
+		sizeStr = bytes.TrimRight(sizeStr, " \t")
+	}
+
+	size, err := strconv.ParseUint(string(sizeStr), 16, 64)
+	if err != nil || size > maxChunkSize {
+		return 0, fmt.Errorf("%w: invalid chunk size %q", ErrMalformedChunk, sizeStr)
+	}
+	return int(size), nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package request
+
+import "context"
+
+// Context returns the request's context. The server cancels it when the
+// client goes away, when the handler returns, or when a shutdown runs out
+// of time. It is never nil
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the request's context, for middleware that adds a
+// deadline or values. ctx should be derived from Context so cancellation
+// still reaches the handler
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// SetValue attaches a value to the request's context for the handlers
+// further down a middleware chain. Use an unexported key type so packages
+// cannot collide
+func (r *Request) SetValue(key, val any) {
+	r.ctx = context.WithValue(r.Context(), key, val)
+}
+
+// Value returns what SetValue stored under key, or nil
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+type (
+	requestIDKey struct{}
+	userKey      struct{}
+	paramsKey    struct{}
+)
+
+// RequestID returns the ID assigned to the request, or ""
+func (r *Request) RequestID() string {
+	id, _ := r.Value(requestIDKey{}).(string)
+	return id
+}
+
+func (r *Request) SetRequestID(id string) {
+	r.SetValue(requestIDKey{}, id)
+}
+
+// User returns the name of the authenticated user, or ""
+func (r *Request) User() string {
+	user, _ := r.Value(userKey{}).(string)
+	return user
+}
+
+func (r *Request) SetUser(user string) {
+	r.SetValue(userKey{}, user)
+}
+
+// Param returns the route parameter called name, or ""
+func (r *Request) Param(name string) string {
+	params, _ := r.Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// SetParams records the parameters a router matched in the target
+func (r *Request) SetParams(params map[string]string) {
+	r.SetValue(paramsKey{}, params)
+}
@@ -0,0 +1,29 @@
+package request
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestContext(t *testing.T) {
+	// Test: Requests built by hand still have a context
+	r := &Request{}
+	assert.NotNil(t, r.Context())
+	assert.Empty(t, r.RequestID())
+	assert.Empty(t, r.Param("id"))
+
+	// Test: Values layer on top of the context without losing cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	r.SetContext(ctx)
+	r.SetRequestID("req-1")
+	r.SetUser("ada")
+	r.SetParams(map[string]string{"id": "42"})
+	assert.Equal(t, "req-1", r.RequestID())
+	assert.Equal(t, "ada", r.User())
+	assert.Equal(t, "42", r.Param("id"))
+
+	cancel()
+	assert.ErrorIs(t, r.Context().Err(), context.Canceled)
+}
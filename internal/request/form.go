@@ -0,0 +1,370 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrNotForm       = errors.New("request body is not a form")
+	ErrFieldTooLarge = errors.New("form field exceeds the size limit")
+	ErrFileTooLarge  = errors.New("uploaded file exceeds the size limit")
+	ErrFormTooLarge  = errors.New("form exceeds the total size limit")
+	ErrTooManyParts  = errors.New("form has too many fields")
+)
+
+// FormLimits bounds form parsing. Zero values pick the defaults noted
+type FormLimits struct {
+	// MaxFieldSize caps a single non-file value. Default 1MiB
+	MaxFieldSize int64
+	// MaxFileSize caps a single uploaded file. Default 32MiB
+	MaxFileSize int64
+	// MaxTotalSize caps everything in the form together. Default 64MiB
+	MaxTotalSize int64
+	// MaxParts caps the number of fields and files. Default 1000
+	MaxParts int
+	// MaxMemory is how many file bytes may be kept in memory in total;
+	// files that do not fit are spooled to TempDir. Default 1MiB
+	MaxMemory int64
+	// TempDir is where spooled files go. Empty means os.TempDir
+	TempDir string
+}
+
+func (l FormLimits) withDefaults() FormLimits {
+	if l.MaxFieldSize == 0 {
+		l.MaxFieldSize = 1 << 20
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = 32 << 20
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = 64 << 20
+	}
+	if l.MaxParts == 0 {
+		l.MaxParts = 1000
+	}
+	if l.MaxMemory == 0 {
+		l.MaxMemory = 1 << 20
+	}
+	return l
+}
+
+// Form is a parsed urlencoded or multipart body
+type Form struct {
+	Value url.Values
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes the files spooled to disk. Call it once the handler is
+// done with the uploads
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpPath != "" {
+				if err := os.Remove(fh.tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileHeader describes an uploaded file held in memory or on disk
+type FileHeader struct {
+	Field string
+	// Filename is the sanitised name the client gave, safe to use as a
+	// path element. It may be empty
+	Filename    string
+	ContentType string
+	Size        int64
+	Header      headers.Headers
+
+	content []byte
+	tmpPath string
+}
+
+// Open returns the file's contents
+func (fh *FileHeader) Open() (io.ReadSeekCloser, error) {
+	if fh.tmpPath != "" {
+		return os.Open(fh.tmpPath)
+	}
+	return nopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// ParseForm parses a urlencoded or multipart/form-data body
+func (r *Request) ParseForm(limits FormLimits) (*Form, error) {
+	limits = limits.withDefaults()
+	mediaType, params, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	if err != nil {
+		return nil, ErrNotForm
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return parseURLEncoded(r.Body, limits)
+	case "multipart/form-data":
+		if params["boundary"] == "" {
+			return nil, fmt.Errorf("%w: missing boundary", ErrNotForm)
+		}
+		return parseMultipart(r.Body, params["boundary"], limits)
+	}
+	return nil, ErrNotForm
+}
+
+func parseURLEncoded(body []byte, limits FormLimits) (*Form, error) {
+	if int64(len(body)) > limits.MaxTotalSize {
+		return nil, ErrFormTooLarge
+	}
+	if bytes.Count(body, []byte("&"))+1 > limits.MaxParts {
+		return nil, ErrTooManyParts
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotForm, err)
+	}
+	for _, vs := range values {
+		for _, v := range vs {
+			if int64(len(v)) > limits.MaxFieldSize {
+				return nil, ErrFieldTooLarge
+			}
+		}
+	}
+	return &Form{Value: values, File: map[string][]*FileHeader{}}, nil
+}
+
+func parseMultipart(body []byte, boundary string, limits FormLimits) (form *Form, err error) {
+	mr := newMultipartReader(body, boundary, limits)
+	form = &Form{Value: url.Values{}, File: map[string][]*FileHeader{}}
+	defer func() {
+		if err != nil {
+			_ = form.RemoveAll()
+		}
+	}()
+
+	memory := limits.MaxMemory
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return form, err
+		}
+
+		if !part.IsFile() {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return form, err
+			}
+			form.Value.Add(part.Field, string(value))
+			continue
+		}
+
+		fh := &FileHeader{
+			Field:       part.Field,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			Header:      part.Header,
+		}
+		if err := spool(fh, part, &memory, limits.TempDir); err != nil {
+			return form, err
+		}
+		form.File[part.Field] = append(form.File[part.Field], fh)
+	}
+}
+
+// spool keeps a file in memory while it fits in the remaining budget and
+// moves it to a temporary file once it does not
+func spool(fh *FileHeader, part *Part, memory *int64, dir string) error {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, *memory+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= *memory {
+		*memory -= n
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return nil
+	}
+
+	f, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return err
+	}
+	fh.tmpPath = f.Name()
+	size, err := io.Copy(f, io.MultiReader(&buf, part))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.tmpPath)
+		fh.tmpPath = ""
+		return err
+	}
+	fh.Size = size
+	return nil
+}
+
+// MultipartReader walks the parts of a multipart/form-data body one at a
+// time, so a handler can act on each without ParseForm copying out every
+// value and file first. It does not stream from the connection: the body
+// is already buffered in Request.Body, and Options.MaxBodySize is what
+// bounds it
+type MultipartReader struct {
+	mr     *multipart.Reader
+	limits FormLimits
+	parts  int
+	total  int64
+}
+
+// MultipartReader returns a part-by-part reader over the buffered
+// multipart/form-data body
+func (r *Request) MultipartReader(limits FormLimits) (*MultipartReader, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ErrNotForm
+	}
+	return newMultipartReader(r.Body, params["boundary"], limits.withDefaults()), nil
+}
+
+func newMultipartReader(body []byte, boundary string, limits FormLimits) *MultipartReader {
+	return &MultipartReader{
+		mr:     multipart.NewReader(bytes.NewReader(body), boundary),
+		limits: limits,
+	}
+}
+
+// Part is one field or file. Reading past a limit returns ErrFieldTooLarge,
+// ErrFileTooLarge or ErrFormTooLarge
+type Part struct {
+	Field string
+	// Filename is sanitised; see FileHeader.Filename
+	Filename    string
+	ContentType string
+	Header      headers.Headers
+
+	isFile bool
+	mr     *MultipartReader
+	p      *multipart.Part
+	read   int64
+	limit  int64
+}
+
+// IsFile reports whether the part carried a filename parameter
+func (p *Part) IsFile() bool {
+	return p.isFile
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	n, err := p.p.Read(b)
+	p.read += int64(n)
+	p.mr.total += int64(n)
+	if p.read > p.limit {
+		if p.isFile {
+			return n, ErrFileTooLarge
+		}
+		return n, ErrFieldTooLarge
+	}
+	if p.mr.total > p.mr.limits.MaxTotalSize {
+		return n, ErrFormTooLarge
+	}
+	return n, err
+}
+
+// NextPart returns the next part, or io.EOF after the last one. Whatever
+// was left unread of the previous part is skipped without counting against
+// the limits
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	p, err := mr.mr.NextPart()
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("%w: %v", ErrNotForm, err)
+		}
+		return nil, err
+	}
+	mr.parts++
+	if mr.parts > mr.limits.MaxParts {
+		return nil, ErrTooManyParts
+	}
+
+	disposition, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "form-data" {
+		return nil, fmt.Errorf("%w: bad Content-Disposition", ErrNotForm)
+	}
+
+	part := &Part{
+		Field:       params["name"],
+		ContentType: p.Header.Get("Content-Type"),
+		Header:      headers.Headers{},
+		mr:          mr,
+		p:           p,
+		limit:       mr.limits.MaxFieldSize,
+	}
+	for k, vs := range p.Header {
+		part.Header[strings.ToLower(k)] = strings.Join(vs, ", ")
+	}
+	if filename, ok := params["filename"]; ok {
+		part.isFile = true
+		part.Filename = SanitizeFilename(filename)
+		part.limit = mr.limits.MaxFileSize
+		if part.ContentType == "" {
+			part.ContentType = "application/octet-stream"
+		}
+	}
+	return part, nil
+}
+
+// maxFilenameLen is the usual filesystem limit on a path element, in bytes
+const maxFilenameLen = 255
+
+// SanitizeFilename reduces a client supplied filename to a single safe
+// path element: directories are stripped, control and reserved characters
+// replaced, and leading dots plus trailing dots and spaces removed so the
+// result is neither hidden nor altered by Windows. A name that reduces to
+// nothing comes back empty
+func SanitizeFilename(name string) string {
+	// Browsers on Windows may send the full path
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			b.WriteByte('_')
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	name = strings.TrimLeft(name, ".")
+
+	for len(name) > maxFilenameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
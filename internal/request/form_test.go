@@ -0,0 +1,177 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(contentType string, body []byte) *Request {
+	return &Request{
+		Headers: headers.Headers{"content-type": contentType},
+		Body:    body,
+	}
+}
+
+// multipartBody builds a form with a text field and the given files
+func multipartBody(t *testing.T, files map[string][]byte) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	require.NoError(t, mw.WriteField("title", "holiday photos"))
+	require.NoError(t, mw.WriteField("tag", "beach"))
+	require.NoError(t, mw.WriteField("tag", "sun"))
+	for name, content := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="upload"; filename="`+name+`"`)
+		h.Set("Content-Type", "image/jpeg")
+		w, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		_, err = w.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestParseURLEncodedForm(t *testing.T) {
+	// Test: Values are decoded and repeated keys kept in order
+	r := formRequest("application/x-www-form-urlencoded; charset=utf-8", []byte("name=J%C3%BCrgen+K&tag=a&tag=b&empty="))
+	form, err := r.ParseForm(FormLimits{})
+	require.NoError(t, err)
+	assert.Equal(t, "Jürgen K", form.Value.Get("name"))
+	assert.Equal(t, []string{"a", "b"}, form.Value["tag"])
+	assert.Equal(t, "", form.Value.Get("empty"))
+
+	// Test: Limits
+	_, err = formRequest("application/x-www-form-urlencoded", []byte("a="+strings.Repeat("x", 11))).ParseForm(FormLimits{MaxFieldSize: 10})
+	require.ErrorIs(t, err, ErrFieldTooLarge)
+	_, err = formRequest("application/x-www-form-urlencoded", []byte("a=1&b=2&c=3")).ParseForm(FormLimits{MaxParts: 2})
+	require.ErrorIs(t, err, ErrTooManyParts)
+	_, err = formRequest("application/x-www-form-urlencoded", []byte("a=12345")).ParseForm(FormLimits{MaxTotalSize: 4})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: Bad escapes and other content types
+	_, err = formRequest("application/x-www-form-urlencoded", []byte("a=%zz")).ParseForm(FormLimits{})
+	require.ErrorIs(t, err, ErrNotForm)
+	_, err = formRequest("application/json", []byte("{}")).ParseForm(FormLimits{})
+	require.ErrorIs(t, err, ErrNotForm)
+	_, err = formRequest("multipart/form-data", nil).ParseForm(FormLimits{})
+	require.ErrorIs(t, err, ErrNotForm)
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	small := []byte("tiny jpeg")
+	large := bytes.Repeat([]byte("J"), 4096)
+	contentType, body := multipartBody(t, map[string][]byte{
+		"small.jpg":             small,
+		`C:\Users\me\large.jpg`: large,
+	})
+	dir := t.TempDir()
+
+	// Test: Fields and files, with the large file spooled to disk
+	form, err := formRequest(contentType, body).ParseForm(FormLimits{MaxMemory: 1024, TempDir: dir})
+	require.NoError(t, err)
+	assert.Equal(t, "holiday photos", form.Value.Get("title"))
+	assert.Equal(t, []string{"beach", "sun"}, form.Value["tag"])
+	require.Len(t, form.File["upload"], 2)
+
+	byName := map[string]*FileHeader{}
+	for _, fh := range form.File["upload"] {
+		byName[fh.Filename] = fh
+	}
+	require.Contains(t, byName, "large.jpg")
+	require.Contains(t, byName, "small.jpg")
+	assert.Equal(t, "image/jpeg", byName["large.jpg"].ContentType)
+	assert.Equal(t, int64(len(large)), byName["large.jpg"].Size)
+	assert.Empty(t, byName["small.jpg"].tmpPath)
+	assert.NotEmpty(t, byName["large.jpg"].tmpPath)
+
+	for name, want := range map[string][]byte{"small.jpg": small, "large.jpg": large} {
+		f, err := byName[name].Open()
+		require.NoError(t, err)
+		got, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		assert.Equal(t, want, got, name)
+	}
+
+	// Test: RemoveAll cleans the spool directory
+	require.NoError(t, form.RemoveAll())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Oversized file fails and leaves nothing behind
+	_, err = formRequest(contentType, body).ParseForm(FormLimits{MaxMemory: 1024, MaxFileSize: 1000, TempDir: dir})
+	require.ErrorIs(t, err, ErrFileTooLarge)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Field, total and part limits
+	_, err = formRequest(contentType, body).ParseForm(FormLimits{MaxFieldSize: 5})
+	require.ErrorIs(t, err, ErrFieldTooLarge)
+	_, err = formRequest(contentType, body).ParseForm(FormLimits{MaxTotalSize: 2048})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+	_, err = formRequest(contentType, body).ParseForm(FormLimits{MaxParts: 3})
+	require.ErrorIs(t, err, ErrTooManyParts)
+}
+
+func TestMultipartReaderParts(t *testing.T) {
+	contentType, body := multipartBody(t, map[string][]byte{"../../etc/passwd": []byte("root:x:0:0")})
+	mr, err := formRequest(contentType, body).MultipartReader(FormLimits{MaxFileSize: 4})
+	require.NoError(t, err)
+
+	// Test: Parts come back in order and unread ones are skipped
+	var fields []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		fields = append(fields, part.Field)
+		if part.IsFile() {
+			assert.Equal(t, "passwd", part.Filename)
+			// Test: The file limit applies while reading a part
+			_, err := io.ReadAll(part)
+			require.ErrorIs(t, err, ErrFileTooLarge)
+		}
+	}
+	assert.Equal(t, []string{"title", "tag", "tag", "upload"}, fields)
+
+	_, err = formRequest("text/plain", body).MultipartReader(FormLimits{})
+	require.ErrorIs(t, err, ErrNotForm)
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := map[string]string{
+		"report.pdf":                "report.pdf",
+		"../../etc/passwd":          "passwd",
+		`C:\Windows\system32\a.dll`: "a.dll",
+		"..":                        "",
+		".htaccess":                 "htaccess",
+		"name. . ":                  "name",
+		"a\x00b\nc.txt":             "a_b_c.txt",
+		`what?<is>"this"|*.txt`:     "what__is__this___.txt",
+		"résumé.docx":               "résumé.docx",
+		"":                          "",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, SanitizeFilename(in), "%q", in)
+	}
+
+	// Test: Long names are cut on a rune boundary
+	long := SanitizeFilename(strings.Repeat("é", 200))
+	assert.LessOrEqual(t, len(long), maxFilenameLen)
+	assert.Equal(t, strings.Repeat("é", 127), long)
+}
@@ -0,0 +1,170 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var ErrHeaderTooLarge = errors.New("request line or header exceeds the read buffer limit")
+
+const (
+	// initialBufferSize fits a typical request head in a single read
+	initialBufferSize = 4096
+	// maxBufferSize bounds how far the buffer grows while waiting for a
+	// CRLF. Body bytes never sit in the buffer for long, so only an
+	// oversized line can hit this
+	maxBufferSize = 64 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, initialBufferSize)
+		return &b
+	},
+}
+
+// Reader parses consecutive requests from a single connection. Bytes read
+// past the end of one request stay buffered for the next one
+type Reader struct {
+	r     io.Reader
+	opts  Options
+	buf   *[]byte
+	start int
+	end   int
+}
+
+func NewReader(r io.Reader, opts Options) *Reader {
+	return &Reader{
+		r:    r,
+		opts: opts,
+		buf:  bufferPool.Get().(*[]byte),
+	}
+}
+
+// ReadRequest parses the next request. It returns io.EOF when the
+// connection closes cleanly between requests
+func (rd *Reader) ReadRequest() (*Request, error) {
+	output := &Request{state: Initialized, opts: rd.opts}
+
+	for {
+		// 1. Parse as much as possible from what is already buffered
+		for rd.start < rd.end && output.state != Done {
+			consumed, err := output.parse((*rd.buf)[rd.start:rd.end])
+			if err != nil {
+				return nil, err
+			}
+			if consumed == 0 {
+				break
+			}
+			rd.start += consumed
+		}
+
+		if output.state == Done {
+			return output, nil
+		}
+
+		// 2. Pull more bytes off the wire
+		if err := rd.fill(); err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			// EOF is only clean between requests. Mid-message it means the
+			// client hung up early, and handing back the partial request
+			// would let a truncated body pass for a complete one
+			switch output.state {
+			case Initialized:
+				if rd.start == rd.end {
+					return nil, io.EOF
+				}
+			case ParsingBody:
+				return nil, ErrContextSmall
+			case ParsingChunkSize, ParsingChunkData, ParsingChunkEnd, ParsingTrailers:
+				return nil, fmt.Errorf("%w: unexpected EOF", ErrMalformedChunk)
+			}
+			return nil, fmt.Errorf("%w: unexpected EOF", ErrMalformedRequest)
+		}
+	}
+}
+
+// HasPrefix reports whether the stream starts with prefix, reading only as
+// much as it takes to tell. Nothing is consumed
+func (rd *Reader) HasPrefix(prefix []byte) (bool, error) {
+	for {
+		buf := rd.Buffered()
+		n := min(len(buf), len(prefix))
+		if !bytes.Equal(buf[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		if err := rd.fill(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// ReadAhead reads whatever the connection sends next into the buffer,
+// without parsing it, and blocks until at least one byte or an error
+// arrives. It must not run at the same time as any other method
+func (rd *Reader) ReadAhead() error {
+	return rd.fill()
+}
+
+// Buffered returns the bytes read from the connection but not yet parsed.
+// The slice is only valid until the next ReadRequest or Release
+func (rd *Reader) Buffered() []byte {
+	if rd.buf == nil {
+		return nil
+	}
+	return (*rd.buf)[rd.start:rd.end]
+}
+
+// Release hands the buffer back to the pool. The Reader must not be used
+// afterwards
+func (rd *Reader) Release() {
+	if rd.buf == nil {
+		return
+	}
+	if cap(*rd.buf) == initialBufferSize {
+		bufferPool.Put(rd.buf)
+	}
+	rd.buf = nil
+	rd.start, rd.end = 0, 0
+}
+
+// fill reads at least one more byte into the buffer, compacting or growing
+// it first when there is no room left
+func (rd *Reader) fill() error {
+	buf := *rd.buf
+
+	if rd.end == len(buf) {
+		if rd.start > 0 {
+			copy(buf, buf[rd.start:rd.end])
+			rd.end -= rd.start
+			rd.start = 0
+		} else {
+			if len(buf) >= maxBufferSize {
+				return ErrHeaderTooLarge
+			}
+			grown := make([]byte, min(len(buf)*2, maxBufferSize))
+			copy(grown, buf[:rd.end])
+			buf = grown
+			rd.buf = &grown
+		}
+	}
+
+	for {
+		n, err := rd.r.Read(buf[rd.end:])
+		rd.end += n
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
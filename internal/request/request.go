@@ -1,19 +1,21 @@
 package request
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"regexp"
+	"net"
+	"net/url"
 	"strconv"
-	"strings"
 
 	"github.com/isparth/httpfromtcp/internal/headers"
 )
 
 var (
 	ErrMalformedRequest       = errors.New("malformed request line")
-	ErrUnsupportedMethod      = errors.New("invalid or non-uppercase method")
+	ErrUnsupportedMethod      = errors.New("method is not a valid token")
 	ErrInvalidTarget          = errors.New("invalid request target path")
 	ErrProtocolVersion        = errors.New("unsupported protocol version")
 	ErrIncorrectContextLength = errors.New("Context length cannot be converted to an int")
@@ -21,9 +23,66 @@ var (
 	ErrContextSmall           = errors.New("Body has less data than specified by the content length")
 )
 
+// Options tunes how a request is parsed
+type Options struct {
+	// Strict rejects every framing ambiguity listed in RFC 9112 6.3 and 11.2
+	// instead of resolving it, closing off request smuggling vectors
+	Strict bool
+	// ProxyMode accepts the absolute-form and authority-form targets a
+	// forward proxy receives (RFC 9112 3.2.2 and 3.2.3)
+	ProxyMode bool
+	// MaxBodySize caps a request body, chunked or not, while it is being
+	// read. Zero means no limit
+	MaxBodySize int
+}
+
+// Method is an HTTP request method token
+type Method string
+
+const (
+	MethodGet     Method = "GET"
+	MethodHead    Method = "HEAD"
+	MethodPost    Method = "POST"
+	MethodPut     Method = "PUT"
+	MethodPatch   Method = "PATCH"
+	MethodDelete  Method = "DELETE"
+	MethodConnect Method = "CONNECT"
+	MethodOptions Method = "OPTIONS"
+	MethodTrace   Method = "TRACE"
+)
+
+// knownMethods is the registry of methods the server understands. The
+// values double as interned strings for the parser
+var knownMethods = map[string]Method{
+	"GET":     MethodGet,
+	"HEAD":    MethodHead,
+	"POST":    MethodPost,
+	"PUT":     MethodPut,
+	"PATCH":   MethodPatch,
+	"DELETE":  MethodDelete,
+	"CONNECT": MethodConnect,
+	"OPTIONS": MethodOptions,
+	"TRACE":   MethodTrace,
+}
+
+// KnownMethods returns the registered methods in a stable order
+func KnownMethods() []Method {
+	return []Method{
+		MethodGet, MethodHead, MethodPost, MethodPut, MethodPatch,
+		MethodDelete, MethodConnect, MethodOptions, MethodTrace,
+	}
+}
+
+// IsKnownMethod reports whether m is one of the registered methods
+func IsKnownMethod(m Method) bool {
+	_, ok := knownMethods[string(m)]
+	return ok
+}
+
 var (
-	targetRegex  = regexp.MustCompile(`^/`)
-	versionRegex = regexp.MustCompile(`^HTTP/(\d+\.\d+)$`)
+	crlf       = []byte("\r\n")
+	httpPrefix = []byte("HTTP/")
+	http11     = []byte("HTTP/1.1")
 )
 
 // ParserState is our custom "enum" type
@@ -34,20 +93,43 @@ const (
 	Initialized ParserState = iota
 	ParsingHeaders
 	ParsingBody
+	ParsingChunkSize
+	ParsingChunkData
+	ParsingChunkEnd
+	ParsingTrailers
 	Done
 )
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
+	Trailers    headers.Headers
 	Body        []byte
-	state       ParserState
+	// Connection details, set by the server. RemoteAddr is the peer's
+	// host:port, which is a proxy's when one sits in front. ClientIP is the
+	// originating client, taken from forwarding headers when the peer is a
+	// trusted proxy. ConnID numbers connections from 1 and ConnRequest
+	// counts the requests served on this one, this one included
+	RemoteAddr  string
+	LocalAddr   string
+	ClientIP    string
+	ConnID      uint64
+	ConnRequest int
+
+	state ParserState
+	opts  Options
+
+	contentLength  int
+	chunkRemaining int
+	closeAfter     bool
+
+	ctx context.Context
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
-	Method        string
+	Method        Method
 }
 
 func (rl RequestLine) String() string {
@@ -58,6 +140,12 @@ func (rl RequestLine) String() string {
 	)
 }
 
+// WantsClose reports whether the connection must be closed after this
+// request is answered instead of being reused for the next one
+func (r *Request) WantsClose() bool {
+	return r.closeAfter || r.Headers.HasToken("Connection", "close")
+}
+
 func (r Request) String() string {
 	return fmt.Sprintf("%s\n%s\nBody:\n%s\n", r.RequestLine.String(), r.Headers.String(), string(r.Body))
 }
@@ -66,7 +154,7 @@ func (r *Request) parse(data []byte) (int, error) {
 	switch r.state {
 
 	case Initialized:
-		requestLine, err, consumed := parseRequestLine(string(data))
+		requestLine, err, consumed := parseRequestLine(data, r.opts)
 		if err != nil {
 			return 0, err
 		}
@@ -91,47 +179,24 @@ func (r *Request) parse(data []byte) (int, error) {
 			return consumed, nil
 		}
 
-		// Headers done: missing Content-Length => 0
-		clStr := r.Headers.Get("Content-Length")
-		if clStr == "" {
-			r.state = Done
-			return consumed, nil
-		}
-
-		contentLength, err := strconv.Atoi(clStr)
-		if err != nil || contentLength < 0 {
-			return consumed, ErrIncorrectContextLength
-		}
-
-		if contentLength == 0 {
-			r.state = Done
-			return consumed, nil
+		if err := r.resolveFraming(); err != nil {
+			return consumed, err
 		}
-
-		r.state = ParsingBody
 		return consumed, nil
 
 	case ParsingBody:
-		clStr := r.Headers.Get("Content-Length")
-		contentLength, err := strconv.Atoi(clStr)
-		if err != nil || contentLength < 0 {
-			return 0, ErrIncorrectContextLength
-		}
+		// Anything past Content-Length belongs to the next request
+		n := min(len(data), r.contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
 
-		r.Body = append(r.Body, data...)
-
-		if len(r.Body) > contentLength {
-			return len(data), fmt.Errorf(
-				"%w: expected %d, got %d",
-				ErrContextLengthExceeded, contentLength, len(r.Body),
-			)
-		}
-
-		if len(r.Body) == contentLength {
+		if len(r.Body) == r.contentLength {
 			r.state = Done
 		}
 
-		return len(data), nil
+		return n, nil
+
+	case ParsingChunkSize, ParsingChunkData, ParsingChunkEnd, ParsingTrailers:
+		return r.parseChunked(data)
 
 	case Done:
 		return 0, nil
@@ -141,85 +206,127 @@ func (r *Request) parse(data []byte) (int, error) {
 }
 
 func RequestFromReader(r io.Reader) (*Request, error) {
-	output := &Request{state: Initialized}
-	// This buffer accumulates data across multiple Read calls
-	var accumulated []byte
-	// Temporary buffer for the current Read
-	readBuf := make([]byte, 8)
-
-	for {
-		n, err := r.Read(readBuf)
-
-		if n > 0 {
-			// Read
-			accumulated = append(accumulated, readBuf[:n]...)
-
-			// Parse as much as possible from accumulated bytes.
-			for len(accumulated) > 0 {
-				consumed, parseErr := output.parse(accumulated)
-				if parseErr != nil {
-					return nil, parseErr
-				}
-				if consumed == 0 {
-					break
-				}
-				accumulated = accumulated[consumed:]
-			}
-		}
+	return RequestFromReaderWithOptions(r, Options{})
+}
 
-		if output.state == Done {
-			break
-		}
+func RequestFromReaderWithOptions(r io.Reader, opts Options) (*Request, error) {
+	reader := NewReader(r, opts)
+	defer reader.Release()
 
-		if err != nil {
-			if err == io.EOF {
+	output, err := reader.ReadRequest()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: unexpected EOF", ErrMalformedRequest)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-				break
-			}
-			return nil, err
-		}
+	// A single request has nowhere to carry extra body bytes to
+	if extra := len(reader.Buffered()); extra > 0 && output.contentLength > 0 {
+		return nil, fmt.Errorf(
+			"%w: expected %d, got %d",
+			ErrContextLengthExceeded, output.contentLength, output.contentLength+extra,
+		)
 	}
 
 	return output, nil
 }
 
-func parseRequestLine(line string) (*RequestLine, error, int) {
-	idx := strings.Index(line, "\r\n")
+func parseRequestLine(data []byte, opts Options) (*RequestLine, error, int) {
+	idx := bytes.Index(data, crlf)
 	if idx == -1 {
 		// Not enough data yet, return 0 consumed and no error
 		return nil, nil, 0
 	}
 
 	totalConsumed := idx + 2
-	rawLine := line[:idx]
+	line := data[:idx]
 
-	parts := strings.Split(rawLine, " ")
-	if len(parts) != 3 {
+	// Exactly three fields separated by single spaces
+	sp1 := bytes.IndexByte(line, ' ')
+	if sp1 == -1 {
+		return nil, ErrMalformedRequest, 0
+	}
+	sp2 := bytes.IndexByte(line[sp1+1:], ' ')
+	if sp2 == -1 {
+		return nil, ErrMalformedRequest, 0
+	}
+	sp2 += sp1 + 1
+	if bytes.IndexByte(line[sp2+1:], ' ') != -1 {
 		return nil, ErrMalformedRequest, 0
 	}
 
-	method, target, proto := parts[0], parts[1], parts[2]
+	method, target, proto := line[:sp1], line[sp1+1:sp2], line[sp2+1:]
 
-	if method != strings.ToUpper(method) {
+	// Case matters (RFC 9110 9.1), but a lowercase token is still a method:
+	// it is left for the registry to turn away with 501 rather than a 400
+	if !headers.IsToken(method) {
 		return nil, ErrUnsupportedMethod, 0
 	}
-	if !targetRegex.MatchString(target) {
-		return nil, ErrInvalidTarget, 0
-	}
-
-	versionMatch := versionRegex.FindStringSubmatch(proto)
-	if len(versionMatch) != 2 {
-		return nil, ErrProtocolVersion, 0
+	if err := checkTarget(method, target, opts.ProxyMode); err != nil {
+		return nil, err, 0
 	}
 
-	version := versionMatch[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("%w: expected 1.1, got %s", ErrProtocolVersion, version), 0
+	if !bytes.Equal(proto, http11) {
+		if !isVersion(proto) {
+			return nil, ErrProtocolVersion, 0
+		}
+		return nil, fmt.Errorf("%w: expected 1.1, got %s", ErrProtocolVersion, proto[len(httpPrefix):]), 0
 	}
 
 	return &RequestLine{
-		Method:        method,
-		RequestTarget: target,
-		HttpVersion:   version,
+		Method:        internMethod(method),
+		RequestTarget: string(target),
+		HttpVersion:   "1.1",
 	}, nil, totalConsumed
 }
+
+// checkTarget validates the request-target form against the method.
+// Outside proxy mode only origin-form is allowed
+func checkTarget(method, target []byte, proxy bool) error {
+	if Method(method) == MethodConnect {
+		if !proxy {
+			return ErrInvalidTarget
+		}
+		// authority-form: host ":" port
+		host, port, err := net.SplitHostPort(string(target))
+		if err != nil || host == "" {
+			return fmt.Errorf("%w: CONNECT needs host:port, got %q", ErrInvalidTarget, target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%w: bad port in %q", ErrInvalidTarget, target)
+		}
+		return nil
+	}
+
+	if len(target) > 0 && target[0] == '/' {
+		return nil
+	}
+	if !proxy {
+		return ErrInvalidTarget
+	}
+
+	// absolute-form
+	u, err := url.Parse(string(target))
+	if err != nil || u.Scheme != "http" || u.Host == "" || u.User != nil {
+		return fmt.Errorf("%w: got %q", ErrInvalidTarget, target)
+	}
+	return nil
+}
+
+// internMethod avoids allocating for registered methods
+func internMethod(b []byte) Method {
+	if m, ok := knownMethods[string(b)]; ok {
+		return m
+	}
+	return Method(b)
+}
+
+// isVersion matches HTTP/DIGITS.DIGITS
+func isVersion(proto []byte) bool {
+	if !bytes.HasPrefix(proto, httpPrefix) {
+		return false
+	}
+	major, minor, ok := bytes.Cut(proto[len(httpPrefix):], []byte("."))
+	return ok && isDigits(string(major)) && isDigits(string(minor))
+}
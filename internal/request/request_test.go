@@ -35,7 +35,7 @@ func TestRequestLineParse(t *testing.T) {
 	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, MethodGet, r.RequestLine.Method)
 	assert.Equal(t, "/", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
@@ -43,7 +43,7 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, MethodGet, r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
@@ -55,7 +55,7 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, MethodPost, r.RequestLine.Method)
 	assert.Equal(t, "/", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
@@ -79,7 +79,7 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, MethodGet, r.RequestLine.Method)
 	assert.Equal(t, "/", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
@@ -91,12 +91,72 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, MethodGet, r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
 }
 
+func TestMethodParsing(t *testing.T) {
+	// Test: Every known method is accepted
+	for _, m := range KnownMethods() {
+		// CONNECT only takes an authority-form target, which needs proxy mode
+		target, opts := "/", Options{}
+		if m == MethodConnect {
+			target, opts = "localhost:443", Options{ProxyMode: true}
+		}
+		r, err := RequestFromReaderWithOptions(strings.NewReader(string(m)+" "+target+" HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"), opts)
+		require.NoError(t, err)
+		assert.Equal(t, m, r.RequestLine.Method)
+		assert.True(t, IsKnownMethod(r.RequestLine.Method))
+	}
+
+	// Test: Unknown but well-formed method is parsed, not registered
+	r, err := RequestFromReader(strings.NewReader("BREW / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, Method("BREW"), r.RequestLine.Method)
+	assert.False(t, IsKnownMethod(r.RequestLine.Method))
+
+	// Test: Punctuation outside the token grammar
+	_, err = RequestFromReader(strings.NewReader("G@T / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedMethod)
+
+	// Test: Lowercase and mixed-case tokens parse but are not the
+	// registered methods, since methods are case-sensitive
+	for _, m := range []string{"get", "M-search"} {
+		r, err = RequestFromReader(strings.NewReader(m + " / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, Method(m), r.RequestLine.Method)
+		assert.False(t, IsKnownMethod(r.RequestLine.Method))
+	}
+}
+
+func TestProxyTargets(t *testing.T) {
+	proxy := Options{ProxyMode: true}
+
+	// Test: absolute-form in proxy mode
+	r, err := RequestFromReaderWithOptions(strings.NewReader("GET http://example.com/coffee?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"), proxy)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/coffee?x=1", r.RequestLine.RequestTarget)
+
+	// Test: authority-form for CONNECT in proxy mode
+	r, err = RequestFromReaderWithOptions(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"), proxy)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+
+	// Test: Both forms are rejected outside proxy mode
+	_, err = RequestFromReader(strings.NewReader("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: CONNECT without a port, absolute-form with credentials
+	_, err = RequestFromReaderWithOptions(strings.NewReader("CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n"), proxy)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = RequestFromReaderWithOptions(strings.NewReader("GET http://user:pw@example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"), proxy)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+}
+
 func TestHeadersParsing(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -161,3 +221,189 @@ func TestBodyParsing(t *testing.T) {
 }
 
 // Test: Standard Body
+
+func TestChunkedBodyParsing(t *testing.T) {
+	// Test: Chunked body with extension and trailer
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6;name=value\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers["x-checksum"])
+
+	// Test: Transfer-Encoding overrides Content-Length in lenient mode
+	r, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Length: 3\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Empty(t, r.Headers["content-length"])
+
+	// Test: Repeated identical Content-Length in lenient mode
+	r, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Length: 5\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Truncated chunked body
+	_, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhel"))
+	require.ErrorIs(t, err, ErrMalformedChunk)
+}
+
+// smugglingCorpus holds payloads known to desync front-end and back-end
+// parsers. Each must be rejected in strict mode
+var smugglingCorpus = []struct {
+	name string
+	raw  string
+	// lenient is true when lenient mode is allowed to resolve the ambiguity
+	lenient bool
+}{
+	{"CL.CL differing", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", false},
+	{"CL.CL identical", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", true},
+	{"CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nhello", true},
+	{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED", true},
+	{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n", true},
+	{"TE.TE unknown coding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n0\r\n\r\n", false},
+	{"TE xchunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", false},
+	{"TE chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", false},
+	{"TE chunked not last", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n", false},
+	{"TE space before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", false},
+	{"TE obs-fold", "POST / HTTP/1.1\r\nHost: a\r\nX-Foo: bar\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+	{"TE vertical tab", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \x0bchunked\r\n\r\n0\r\n\r\n", false},
+	{"CL plus sign", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello", false},
+	{"CL hex", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello", false},
+	{"CL negative", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", false},
+	{"CL overflow", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n", false},
+	{"bare CR in value", "POST / HTTP/1.1\r\nHost: a\r\nX-Foo: a\rContent-Length: 5\r\n\r\nhello", false},
+	{"NUL in value", "POST / HTTP/1.1\r\nHost: a\r\nX-Foo: a\x00b\r\n\r\n", false},
+	{"chunk size with space", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n", true},
+	{"chunk size hex prefix", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n", false},
+	{"chunk size overflow", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffff1\r\nhello\r\n0\r\n\r\n", false},
+	{"chunk data overrun", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n", false},
+	{"chunk bare LF in extension", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a\nb\r\nhello\r\n0\r\n\r\n", false},
+	{"trailer smuggles framing", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nContent-Length: 5\r\n\r\n", true},
+	{"missing Host", "GET / HTTP/1.1\r\nX-Foo: a\r\n\r\n", true},
+	{"duplicate Host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", true},
+}
+
+func TestSmugglingCorpus(t *testing.T) {
+	for _, tc := range smugglingCorpus {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := RequestFromReaderWithOptions(strings.NewReader(tc.raw), Options{Strict: true})
+			require.Error(t, err, "strict mode accepted %q", tc.raw)
+
+			_, err = RequestFromReader(strings.NewReader(tc.raw))
+			if tc.lenient {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+const benchRequest = "POST /api/v1/items?limit=50 HTTP/1.1\r\n" +
+	"Host: localhost:42069\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 17\r\n" +
+	"\r\n" +
+	"{\"name\":\"coffee\"}"
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	b.SetBytes(int64(len(benchRequest)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := RequestFromReader(strings.NewReader(benchRequest)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRequestLine(b *testing.B) {
+	line := []byte("GET /api/v1/items?limit=50&offset=100 HTTP/1.1\r\n")
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err, _ := parseRequestLine(line, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReaderCarriesLeftoverBytes(t *testing.T) {
+	// Test: Two requests arriving in one read
+	reader := NewReader(strings.NewReader(
+		"POST /first HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello"+
+			"GET /second HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+	), Options{})
+	defer reader.Release()
+
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.NotEmpty(t, reader.Buffered())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Empty(t, reader.Buffered())
+
+	// Test: Clean EOF between requests
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A header line that never ends is capped
+	long := "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", maxBufferSize) + "\r\n\r\n"
+	_, err = RequestFromReader(&chunkReader{data: long, numBytesPerRead: 4096})
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	opts := Options{MaxBodySize: 5}
+
+	// Test: A body at the limit is fine
+	r, err := RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"), opts)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: A larger Content-Length fails before the body is read
+	_, err = RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\n"), opts)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunks count towards the limit as they are announced
+	r, err = RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n"), opts)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	_, err = RequestFromReaderWithOptions(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nhel\r\n3\r\n"), opts)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
@@ -0,0 +1,49 @@
+package response
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrNotHijackable = errors.New("response writer is not backed by a connection")
+
+// NewConnWriter returns a Writer on conn that handlers may hijack. buffered
+// reports the bytes the request parser has read but not consumed
+func NewConnWriter(conn net.Conn, buffered func() []byte) *Writer {
+	return &Writer{w: conn, state: writerStateStart, conn: conn, buffered: buffered}
+}
+
+// Hijack hands the raw connection to the caller, along with a copy of any
+// bytes already read past the current request. Afterwards the server
+// neither closes nor reuses the connection, and the Writer refuses
+// further writes
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.state == writerStateHijacked {
+		return nil, nil, ErrInvalidWriterState
+	}
+	if w.conn == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	w.state = writerStateHijacked
+
+	var pending []byte
+	if w.buffered != nil {
+		pending = append(pending, w.buffered()...)
+	}
+
+	// The server's idle timeout no longer applies
+	_ = w.conn.SetReadDeadline(time.Time{})
+	return w.conn, pending, nil
+}
+
+// CanHijack reports whether Hijack would hand over a connection. Writers
+// for HTTP/2 streams and middleware buffers cannot
+func (w *Writer) CanHijack() bool {
+	return w.conn != nil && w.state != writerStateHijacked
+}
+
+// Hijacked reports whether Hijack has been called
+func (w *Writer) Hijacked() bool {
+	return w.state == writerStateHijacked
+}
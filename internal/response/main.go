@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 
 	"github.com/isparth/httpfromtcp/internal/headers"
@@ -14,9 +15,24 @@ type StatusCode int
 
 // Define the constants for the status codes we care about
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusPartialContent              StatusCode = 206
+	StatusNotModified                 StatusCode = 304
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusContentTooLarge             StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusUnprocessableContent        StatusCode = 422
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
 )
 
 type Headers = headers.Headers
@@ -30,6 +46,7 @@ const (
 	writerStateBodyWritten
 	writerStateChunked
 	writerStateDone
+	writerStateHijacked
 )
 
 var ErrInvalidWriterState = errors.New("response writer called out of order")
@@ -37,6 +54,21 @@ var ErrInvalidWriterState = errors.New("response writer called out of order")
 type Writer struct {
 	w     io.Writer
 	state writerState
+
+	// Bookkeeping used to decide whether the connection can be reused
+	contentLength int
+	bodyWritten   int
+	closeConn     bool
+
+	// Set when the writer sits on a live connection that can be hijacked
+	conn     net.Conn
+	buffered func() []byte
+
+	// Set when another protocol frames the response
+	sink   Sink
+	status StatusCode
+
+	onHeaders []func(StatusCode, Headers)
 }
 
 func NewWriter(w io.Writer) *Writer {
@@ -44,7 +76,7 @@ func NewWriter(w io.Writer) *Writer {
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	line := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusText(statusCode))
+	line := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
 	_, err := w.Write([]byte(line))
 	return err
 }
@@ -54,6 +86,11 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 		return ErrInvalidWriterState
 	}
 	w.state = writerStateStatusWritten
+	w.status = statusCode
+	if w.sink != nil {
+		// The status travels with the headers
+		return nil
+	}
 	return WriteStatusLine(w.w, statusCode)
 }
 
@@ -61,16 +98,17 @@ func GetDefaultHeaders(contentLen int) Headers {
 
 	h := headers.Headers{}
 	h.Set("Content-Length", strconv.Itoa(contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
 
 func WriteHeaders(w io.Writer, h Headers) error {
 	for key, value := range h {
-		line := fmt.Sprintf("%s: %s\r\n", key, value)
-		if _, err := w.Write([]byte(line)); err != nil {
-			return err
+		for _, v := range headers.Lines(value) {
+			line := fmt.Sprintf("%s: %s\r\n", key, v)
+			if _, err := w.Write([]byte(line)); err != nil {
+				return err
+			}
 		}
 	}
 	// The CRLF that separates headers from the body
@@ -83,15 +121,83 @@ func (w *Writer) WriteHeaders(h Headers) error {
 		return ErrInvalidWriterState
 	}
 	w.state = writerStateHeadersWritten
+
+	if len(w.onHeaders) > 0 && h == nil {
+		h = Headers{}
+	}
+	for _, fn := range w.onHeaders {
+		fn(w.status, h)
+	}
+
+	w.contentLength = -1
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		w.contentLength = cl
+	}
+	w.closeConn = h.HasToken("Connection", "close")
+
+	if w.sink != nil {
+		return w.sink.WriteHeader(w.status, h)
+	}
 	return WriteHeaders(w.w, h)
 }
 
+// OnHeaders registers fn to run just before the headers are written, so
+// middleware can add to them after the handler has chosen them
+func (w *Writer) OnHeaders(fn func(StatusCode, Headers)) {
+	w.onHeaders = append(w.onHeaders, fn)
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.state != writerStateHeadersWritten && w.state != writerStateBodyWritten {
 		return 0, ErrInvalidWriterState
 	}
 	w.state = writerStateBodyWritten
-	return w.w.Write(p)
+	if w.sink != nil {
+		if err := w.sink.WriteData(p); err != nil {
+			return 0, err
+		}
+		w.bodyWritten += len(p)
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	w.bodyWritten += n
+	return n, err
+}
+
+// WriteError sends a complete plain-text response for status. Any extra
+// headers are added on top of the defaults
+func (w *Writer) WriteError(status StatusCode, extra Headers) error {
+	body := []byte(fmt.Sprintf("%d %s\n", status, StatusText(status)))
+	h := GetDefaultHeaders(len(body))
+	for k, v := range extra {
+		h.Set(k, v)
+	}
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
+
+// Reusable reports whether the response was completely and unambiguously
+// delimited, so another response can follow it on the same connection
+func (w *Writer) Reusable() bool {
+	return !w.closeConn && w.Complete()
+}
+
+// Complete reports whether the body was finished: a chunked body was
+// terminated or a Content-Length body was written in full
+func (w *Writer) Complete() bool {
+	switch w.state {
+	case writerStateDone:
+		return true
+	case writerStateHeadersWritten, writerStateBodyWritten:
+		return w.contentLength == w.bodyWritten
+	}
+	return false
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -99,6 +205,13 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, ErrInvalidWriterState
 	}
 	w.state = writerStateChunked
+	if w.sink != nil {
+		if err := w.sink.WriteData(p); err != nil {
+			return 0, err
+		}
+		w.bodyWritten += len(p)
+		return len(p), nil
+	}
 	header := fmt.Sprintf("%x\r\n", len(p))
 	if _, err := w.w.Write([]byte(header)); err != nil {
 		return 0, err
@@ -109,6 +222,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if _, err := w.w.Write([]byte("\r\n")); err != nil {
 		return 0, err
 	}
+	w.bodyWritten += len(p)
 	return len(p), nil
 }
 
@@ -117,6 +231,10 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, ErrInvalidWriterState
 	}
 	w.state = writerStateDone
+	if w.sink != nil {
+		// The sink ends the stream once the handler returns
+		return 0, nil
+	}
 	return w.w.Write([]byte("0\r\n\r\n"))
 }
 
@@ -125,27 +243,63 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		return ErrInvalidWriterState
 	}
 	w.state = writerStateDone
+	if w.sink != nil {
+		return w.sink.WriteTrailers(h)
+	}
 	if _, err := w.w.Write([]byte("0\r\n")); err != nil {
 		return err
 	}
 	for key, value := range h {
-		line := fmt.Sprintf("%s: %s\r\n", key, value)
-		if _, err := w.w.Write([]byte(line)); err != nil {
-			return err
+		for _, v := range headers.Lines(value) {
+			line := fmt.Sprintf("%s: %s\r\n", key, v)
+			if _, err := w.w.Write([]byte(line)); err != nil {
+				return err
+			}
 		}
 	}
 	_, err := w.w.Write([]byte("\r\n"))
 	return err
 }
 
-func statusText(statusCode StatusCode) string {
+// StatusText returns the reason phrase for a status code
+func StatusText(statusCode StatusCode) string {
 	switch statusCode {
+	case StatusSwitchingProtocols:
+		return "Switching Protocols"
 	case StatusOK:
 		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusPartialContent:
+		return "Partial Content"
+	case StatusNotModified:
+		return "Not Modified"
 	case StatusBadRequest:
 		return "Bad Request"
+	case StatusUnauthorized:
+		return "Unauthorized"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusProxyAuthRequired:
+		return "Proxy Authentication Required"
+	case StatusContentTooLarge:
+		return "Content Too Large"
+	case StatusUnsupportedMediaType:
+		return "Unsupported Media Type"
+	case StatusUnprocessableContent:
+		return "Unprocessable Content"
+	case StatusTooManyRequests:
+		return "Too Many Requests"
+	case StatusRequestHeaderFieldsTooLarge:
+		return "Request Header Fields Too Large"
 	case StatusInternalServerError:
 		return "Internal Server Error"
+	case StatusNotImplemented:
+		return "Not Implemented"
+	case StatusBadGateway:
+		return "Bad Gateway"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
 	default:
 		return ""
 	}
@@ -0,0 +1,26 @@
+package response
+
+// Sink receives a response as status, headers and body parts instead of
+// HTTP/1.1 bytes. Protocols with their own framing, such as HTTP/2, plug
+// in here so handlers keep using the same Writer
+type Sink interface {
+	WriteHeader(status StatusCode, h Headers) error
+	WriteData(p []byte) error
+	WriteTrailers(h Headers) error
+}
+
+// NewSinkWriter returns a Writer that reports to s
+func NewSinkWriter(s Sink) *Writer {
+	return &Writer{state: writerStateStart, sink: s}
+}
+
+// Status returns the status code passed to WriteStatusLine, or 0
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BytesWritten returns how many body bytes have been written, not counting
+// chunked framing
+func (w *Writer) BytesWritten() int {
+	return w.bodyWritten
+}
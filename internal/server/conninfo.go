@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/proxyproto"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+// connMeta is what the server knows about the connection a request came in
+// on. requests is shared by the streams of an HTTP/2 connection
+type connMeta struct {
+	conn     net.Conn
+	id       uint64
+	requests atomic.Int64
+}
+
+// annotate fills in the request's connection details
+func (s *Server) annotate(req *request.Request, meta *connMeta) {
+	req.RemoteAddr = meta.conn.RemoteAddr().String()
+	req.LocalAddr = meta.conn.LocalAddr().String()
+	req.ConnID = meta.id
+	req.ConnRequest = int(meta.requests.Add(1))
+	req.ClientIP = clientIP(req.RemoteAddr, req.Headers, s.trusted)
+	if h := proxyHeader(meta.conn); h != nil {
+		proxyproto.SetHeader(req, h)
+	}
+}
+
+// proxyHeader returns the PROXY header conn started with, if it had one
+func proxyHeader(conn net.Conn) *proxyproto.Header {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	pc, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+	h, _ := pc.Header()
+	return h
+}
+
+// streamHandler serves the streams of one HTTP/2 connection
+func (s *Server) streamHandler(meta *connMeta) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		s.annotate(req, meta)
+		s.serveRequest(w, req)
+	}
+}
+
+// clientIP finds the originating client. Each proxy appends the address it
+// got the request from, so the chain is walked from the peer backwards
+// through trusted proxies; the first address that is not one is the
+// client. Anything to the left of it could have been written by the client
+// and is ignored. Forwarded (RFC 7239) wins over X-Forwarded-For when both
+// are present
+func clientIP(remoteAddr string, h headers.Headers, trusted []netip.Prefix) string {
+	peer, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			return host
+		}
+		return remoteAddr
+	}
+	client := peer.Addr().Unmap()
+	if !isTrusted(client, trusted) {
+		return client.String()
+	}
+
+	chain := forwardedFor(h.Get("Forwarded"))
+	if chain == nil {
+		chain = strings.Split(h.Get("X-Forwarded-For"), ",")
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(chain[i])
+		if !ok {
+			// Hidden or garbled: nothing further left can be trusted
+			break
+		}
+		client = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor collects the for= parameters of a Forwarded header in order,
+// or nil if there are none
+func forwardedFor(v string) []string {
+	var out []string
+	for _, element := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				out = append(out, value)
+			}
+		}
+	}
+	return out
+}
+
+// parseForwardedAddr reads one hop: a bare IP, an IP and port, or the
+// quoted and bracketed forms Forwarded uses for IPv6
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/headers"
+	"github.com/isparth/httpfromtcp/internal/proxyproto"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	}
+	tests := []struct {
+		name   string
+		remote string
+		hdrs   map[string]string
+		want   string
+	}{
+		{"no proxy", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's headers are ignored", "203.0.113.7:5000",
+			map[string]string{"x-forwarded-for": "1.2.3.4"}, "203.0.113.7"},
+		{"trusted peer without headers", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"one trusted hop", "10.0.0.1:5000",
+			map[string]string{"x-forwarded-for": "198.51.100.9"}, "198.51.100.9"},
+		{"spoofed entries left of the client are skipped", "10.0.0.1:5000",
+			map[string]string{"x-forwarded-for": "1.2.3.4, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"every hop trusted", "10.0.0.1:5000",
+			map[string]string{"x-forwarded-for": "10.1.1.1, 10.0.0.2"}, "10.1.1.1"},
+		{"garbage stops the walk", "10.0.0.1:5000",
+			map[string]string{"x-forwarded-for": "198.51.100.9, nonsense, 10.0.0.2"}, "10.0.0.2"},
+		{"forwarded with quoted IPv6 and port", "10.0.0.1:5000",
+			map[string]string{"forwarded": `for="[2001:db8::1]:4711";proto=https`}, "2001:db8::1"},
+		{"forwarded beats x-forwarded-for", "10.0.0.1:5000",
+			map[string]string{"forwarded": "for=198.51.100.9, for=10.0.0.2", "x-forwarded-for": "1.2.3.4"}, "198.51.100.9"},
+		{"obfuscated forwarded hop", "10.0.0.1:5000",
+			map[string]string{"forwarded": "for=_hidden, for=10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 trusted peer", "[2001:db8:ffff::1]:443",
+			map[string]string{"x-forwarded-for": "203.0.113.7"}, "203.0.113.7"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.1]:5000",
+			map[string]string{"x-forwarded-for": "203.0.113.7"}, "203.0.113.7"},
+		{"non-IP address", "pipe", nil, "pipe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.Headers{}
+			for k, v := range tt.hdrs {
+				h.Set(k, v)
+			}
+			assert.Equal(t, tt.want, clientIP(tt.remote, h, trusted))
+		})
+	}
+}
+
+func TestConnMetadata(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(fmt.Sprintf("%d %d %s %s %s",
+			req.ConnID, req.ConnRequest, req.ClientIP, req.RemoteAddr, req.LocalAddr))
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody(body)
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	exchange := func() []string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(
+			"GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+				"GET /b HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+
+		var bodies []string
+		for _, resp := range strings.Split(string(out), "HTTP/1.1 ")[1:] {
+			_, body, _ := strings.Cut(resp, "\r\n\r\n")
+			bodies = append(bodies, body)
+		}
+		require.Len(t, bodies, 2)
+
+		// Test: The addresses are the connection's own ends
+		fields := strings.Fields(bodies[0])
+		host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		assert.Equal(t, host, fields[2])
+		assert.Equal(t, conn.LocalAddr().String(), fields[3])
+		assert.Equal(t, conn.RemoteAddr().String(), fields[4])
+		return bodies
+	}
+
+	// Test: Requests on one connection share its ID and are counted
+	first := exchange()
+	a, b := strings.Fields(first[0]), strings.Fields(first[1])
+	assert.Equal(t, a[0], b[0])
+	assert.Equal(t, "1", a[1])
+	assert.Equal(t, "2", b[1])
+
+	// Test: A new connection gets a new ID and starts counting again
+	second := strings.Fields(exchange()[0])
+	assert.NotEqual(t, a[0], second[0])
+	assert.Equal(t, "1", second[1])
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := req.RemoteAddr + " " + req.LocalAddr
+		if h, ok := proxyproto.HeaderFrom(req); ok {
+			id, _ := h.TLV(proxyproto.TypeUniqueID)
+			body += " " + string(id)
+		}
+		_ = w.WriteStatusLine(response.StatusOK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, _ = w.WriteBody([]byte(body))
+	}, WithProxyProtocol(proxyproto.Options{}), WithMaxConnsPerIP(1))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\n" +
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	// Test: Handlers see the addresses from the header, even with a
+	// per-IP limit reading them before the request arrives
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\n192.0.2.1:51000 198.51.100.2:443 "), string(out))
+}
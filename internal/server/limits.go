@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+// OverloadPolicy is what happens to a new connection when the server is
+// already serving its maximum
+type OverloadPolicy int
+
+const (
+	// OverloadBlock stops accepting until a connection closes. New clients
+	// wait in the kernel's listen backlog
+	OverloadBlock OverloadPolicy = iota
+	// OverloadReject accepts the connection and answers 503 straight away,
+	// so clients find out at once instead of timing out
+	OverloadReject
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	// rejectTimeout bounds answering a client that is being turned away
+	// and draining what it still sends
+	rejectTimeout = time.Second
+)
+
+// nextAcceptDelay doubles the wait after each failed Accept, up to a second
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	return min(delay*2, maxAcceptDelay)
+}
+
+// waitForSlot blocks until the global cap leaves room for another
+// connection. It reports false if the server closed while waiting
+func (s *Server) waitForSlot() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-s.closed:
+		return false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// admit checks a new connection against the limits and takes its share of
+// them. In block mode the global slot was already taken before Accept
+func (s *Server) admit(conn net.Conn) bool {
+	if s.overload == OverloadReject && s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	if s.maxConnsPerIP > 0 {
+		ip := remoteIP(conn)
+		s.mu.Lock()
+		if s.perIP[ip] >= s.maxConnsPerIP {
+			s.mu.Unlock()
+			s.releaseSlot()
+			return false
+		}
+		if s.perIP == nil {
+			s.perIP = make(map[string]int)
+		}
+		s.perIP[ip]++
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// release hands back what admit took once the connection is done with.
+// A hijacked connection counts as done when its handler returns
+func (s *Server) release(conn net.Conn) {
+	if s.maxConnsPerIP > 0 {
+		ip := remoteIP(conn)
+		s.mu.Lock()
+		if s.perIP[ip]--; s.perIP[ip] <= 0 {
+			delete(s.perIP, ip)
+		}
+		s.mu.Unlock()
+	}
+	s.releaseSlot()
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// reject answers a connection over a limit with 503 and closes it
+func reject(conn net.Conn) {
+	h := response.Headers{}
+	h.Set("Retry-After", "1")
+	closeWithError(conn, response.StatusServiceUnavailable, h)
+}
+
+// closeWithError answers status on conn and closes it
+func closeWithError(conn net.Conn, status response.StatusCode, h response.Headers) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if h == nil {
+		h = response.Headers{}
+	}
+	h.Set("Connection", "close")
+	if err := response.NewWriter(conn).WriteError(status, h); err != nil {
+		return
+	}
+	// Closing with the request still unread would make the kernel send a
+	// reset, which can destroy the response before the client reads it
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// holdServer serves /hold until release is closed and echoes anything else
+func holdServer(t *testing.T, release chan struct{}, opts ...Option) *Server {
+	t.Helper()
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hold" {
+			<-release
+		}
+		echoTarget(w, req)
+	}, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// send opens a connection, sends a request for target and returns the
+// connection with a reader over it
+func send(t *testing.T, s *Server, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+func statusLine(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(line)
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	release := make(chan struct{})
+	s := holdServer(t, release, WithMaxConns(1, OverloadReject))
+	_, held := send(t, s, "/hold")
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Over the cap gets 503 straight away
+	_, br := send(t, s, "/next")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", statusLine(t, br))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "retry-after: 1")
+
+	// Test: The slot frees up once the first connection ends
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine(t, held))
+	_, _ = io.ReadAll(held)
+	time.Sleep(20 * time.Millisecond)
+	_, br = send(t, s, "/after")
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine(t, br))
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	release := make(chan struct{})
+	s := holdServer(t, release, WithMaxConns(1, OverloadBlock))
+	_, held := send(t, s, "/hold")
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Over the cap waits instead of being answered
+	waiting, br := send(t, s, "/next")
+	_ = waiting.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := br.ReadString('\n')
+	require.Error(t, err)
+
+	_ = waiting.SetReadDeadline(time.Now().Add(5 * time.Second))
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine(t, held))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine(t, br))
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	s := holdServer(t, release, WithMaxConnsPerIP(1))
+	_, held := send(t, s, "/hold")
+	time.Sleep(20 * time.Millisecond)
+
+	_, br := send(t, s, "/next")
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", statusLine(t, br))
+
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine(t, held))
+	_, _ = io.ReadAll(held)
+	time.Sleep(20 * time.Millisecond)
+	s.mu.Lock()
+	assert.Empty(t, s.perIP)
+	s.mu.Unlock()
+}
+
+// failingListener fails every Accept until it is closed
+type failingListener struct {
+	net.Listener
+	calls  atomic.Int32
+	closed atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls.Add(1)
+	if l.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("accept4: too many open files")
+}
+
+func (l *failingListener) Close() error {
+	l.closed.Store(true)
+	return nil
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l := &failingListener{}
+	s := &Server{listener: l, closed: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.listen()
+		close(done)
+	}()
+
+	// Test: Failures back off instead of spinning: 5+10+20+40ms in 100ms
+	time.Sleep(100 * time.Millisecond)
+	calls := l.calls.Load()
+	assert.GreaterOrEqual(t, calls, int32(3))
+	assert.LessOrEqual(t, calls, int32(6))
+
+	// Test: Closing ends the loop even mid-backoff
+	require.NoError(t, s.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listen did not return after Close")
+	}
+
+	assert.Equal(t, time.Second, nextAcceptDelay(800*time.Millisecond))
+}
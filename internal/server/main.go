@@ -1,12 +1,21 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/isparth/httpfromtcp/internal/http2"
+	"github.com/isparth/httpfromtcp/internal/proxyproto"
 	"github.com/isparth/httpfromtcp/internal/request"
 	"github.com/isparth/httpfromtcp/internal/response"
 )
@@ -18,12 +27,57 @@ var (
 type Handler func(w *response.Writer, req *request.Request)
 
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	isClosed atomic.Bool
+	listener       net.Listener
+	handler        Handler
+	isClosed       atomic.Bool
+	nextConnID     atomic.Uint64
+	trusted        []netip.Prefix
+	allowedMethods map[request.Method]struct{}
+	parseOptions   request.Options
+	idleTimeout    time.Duration
+	h2c            bool
+	http2Config    http2.Config
+	tlsConfig      *tls.Config
+	proxyProtocol  *proxyproto.Options
+	observer       Observer
+
+	// baseCtx is the parent of every request context. It is cancelled
+	// when Shutdown gives up waiting
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+
+	// shutdown is closed by Shutdown to drain HTTP/2 connections
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	active       sync.WaitGroup
+
+	// closed wakes the accept loop when it is blocked on a limit or backoff
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Connection limits, see limits.go. slots is nil when there is no
+	// global cap
+	slots         chan struct{}
+	overload      OverloadPolicy
+	maxConnsPerIP int
+
+	// mu guards conns, which maps each open connection to whether it is
+	// waiting for its next HTTP/1 request, and perIP, which counts the
+	// connections from each address
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	perIP map[string]int
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+const (
+	// defaultIdleTimeout bounds how long a kept-alive connection may sit
+	// waiting for its next request
+	defaultIdleTimeout = 30 * time.Second
+	// handshakeTimeout bounds the TLS handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	addr := fmt.Sprintf(":%d", port)
 	l, err := net.Listen("tcp", addr)
 
@@ -32,16 +86,39 @@ func Serve(port int, handler Handler) (*Server, error) {
 	}
 
 	s := &Server{
-		listener: l,
-		handler:  handler,
+		handler:     handler,
+		idleTimeout: defaultIdleTimeout,
+		shutdown:    make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.proxyProtocol != nil {
+		l = proxyproto.NewListener(l, *s.proxyProtocol)
 	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listener = l
 
 	go s.listen()
 	return s, nil
 }
 
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) Close() error {
 	s.isClosed.Store(true)
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
+	})
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -49,32 +126,350 @@ func (s *Server) Close() error {
 	return ErrMissingListenner
 }
 
-func (s *Server) listen() {
+// Shutdown stops accepting connections and waits for the open ones to
+// finish. Idle keep-alive connections are closed straight away and HTTP/2
+// connections are sent GOAWAY. Whatever is still open when ctx ends is
+// closed forcibly
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+	s.shutdownOnce.Do(func() {
+		if s.shutdown != nil {
+			close(s.shutdown)
+		}
+	})
+
+	// Holding mu here also means listen cannot start tracking a new
+	// connection after active.Wait begins
+	s.mu.Lock()
+	for conn, idle := range s.conns {
+		if idle {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
 
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.cancelBase()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) listen() {
+	var delay time.Duration
 	for !s.isClosed.Load() {
+		if s.overload == OverloadBlock && !s.waitForSlot() {
+			return
+		}
 
 		conn, err := s.listener.Accept()
 		if err != nil {
-			// Handle errors (e.g., if the listener is closed)
-			log.Printf("Accept error: %v", err)
+			if s.overload == OverloadBlock {
+				s.releaseSlot()
+			}
+			if errors.Is(err, net.ErrClosed) || s.isClosed.Load() {
+				return
+			}
+			// Errors like running out of file descriptors clear up on
+			// their own; retrying at once would only spin
+			delay = nextAcceptDelay(delay)
+			log.Printf("Accept error: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.closed:
+				return
+			}
 			continue
 		}
+		delay = 0
 
-		go s.handle(conn)
+		s.mu.Lock()
+		if s.isClosed.Load() {
+			s.mu.Unlock()
+			if s.overload == OverloadBlock {
+				s.releaseSlot()
+			}
+			conn.Close()
+			continue
+		}
+		s.active.Add(1)
+		s.mu.Unlock()
 
+		go func() {
+			defer s.active.Done()
+			// Admission runs here rather than in the accept loop because
+			// the remote address of a PROXY protocol connection is only
+			// known once its header has arrived
+			if !s.admit(conn) {
+				reject(conn)
+				return
+			}
+			defer s.release(conn)
+			if s.observer != nil {
+				s.observer.ConnOpened()
+				defer s.observer.ConnClosed()
+			}
+			s.handle(conn)
+		}()
 	}
-
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	s.track(conn, false)
+	meta := &connMeta{conn: conn, id: s.nextConnID.Add(1)}
+	hijacked := false
+	defer func() {
+		s.untrack(conn)
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+
+	// h2c is only ever spoken in cleartext; over TLS, ALPN picks the protocol
+	cleartext := true
+	if tc, ok := conn.(*tls.Conn); ok {
+		cleartext = false
+		if err := s.handshake(tc); err != nil {
+			log.Printf("TLS handshake error: %v", err)
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			s.serveHTTP2(conn, nil, meta)
+			return
+		}
+	}
+
+	reader := request.NewReader(conn, s.parseOptions)
+	defer reader.Release()
+
+	if s.h2c && cleartext && s.servePriorKnowledge(conn, reader, meta) {
+		return
+	}
+
+	// Pipelined requests are parsed off the same reader and answered one
+	// at a time, so responses always go out in request order
+	for !s.isClosed.Load() {
+		s.track(conn, true)
+		if s.idleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		// Shutdown may have run between the loop check and the deadline
+		// above, which would have overwritten its wake-up
+		if s.isClosed.Load() {
+			return
+		}
+
+		req, err := reader.ReadRequest()
+		s.track(conn, false)
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error parsing request: %v", err)
+			if s.observer != nil {
+				s.observer.ParseError(err)
+			}
+			closeWithError(conn, parseErrorStatus(err), nil)
+			return
+		}
+
+		if s.h2c && cleartext && http2.IsUpgrade(req) {
+			s.serveUpgrade(conn, reader, req, meta)
+			return
+		}
 
-	req, err := request.RequestFromReader(conn)
+		writer, done := s.startRequest(conn, reader, req, meta)
+		s.serveRequest(writer, req)
+		done()
+
+		if writer.Hijacked() {
+			hijacked = true
+			return
+		}
+		if req.WantsClose() || !writer.Reusable() {
+			return
+		}
+	}
+}
+
+// startRequest gives an HTTP/1 request its context and watches the
+// connection while the handler runs, so the context is cancelled if the
+// client hangs up. done must be called once the handler returns
+func (s *Server) startRequest(conn net.Conn, reader *request.Reader, req *request.Request, meta *connMeta) (*response.Writer, func()) {
+	ctx, cancel := context.WithCancel(s.base())
+	req.SetContext(ctx)
+	s.annotate(req, meta)
+
+	// Bytes already buffered belong to a pipelined request, so the client
+	// is still there and reading further would only pile up more
+	stopWatch := func() {}
+	if len(reader.Buffered()) == 0 {
+		stopWatch = watchClose(conn, reader, cancel)
+	}
+	writer := response.NewConnWriter(conn, func() []byte {
+		stopWatch()
+		return reader.Buffered()
+	})
+	return writer, func() {
+		stopWatch()
+		cancel()
+	}
+}
+
+func (s *Server) base() context.Context {
+	if s.baseCtx == nil {
+		return context.Background()
+	}
+	return s.baseCtx
+}
+
+// watchClose reads ahead on conn in the background and calls cancel if the
+// connection fails or reaches EOF. Anything read stays buffered for the next
+// request. The returned stop ends the read and must run before reader or
+// conn are read from again
+func watchClose(conn net.Conn, reader *request.Reader, cancel context.CancelFunc) (stop func()) {
+	_ = conn.SetReadDeadline(time.Time{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		if err := reader.ReadAhead(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// A deadline in the past unblocks the read
+			_ = conn.SetReadDeadline(time.Unix(1, 0))
+			<-finished
+			_ = conn.SetReadDeadline(time.Time{})
+		})
+	}
+}
+
+// serveRequest hands a parsed request to the handler. Both protocols go
+// through here so the method policy applies to HTTP/2 streams as well
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	if !s.methodAllowed(req.RequestLine.Method) {
+		_ = w.WriteError(response.StatusNotImplemented, nil)
+		return
+	}
+	s.handler(w, req)
+}
+
+// servePriorKnowledge switches to HTTP/2 when the client opens with the
+// connection preface. It reports whether the connection was taken over
+func (s *Server) servePriorKnowledge(conn net.Conn, reader *request.Reader, meta *connMeta) bool {
+	if s.idleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	}
+	ok, err := reader.HasPrefix([]byte(http2.ClientPreface))
 	if err != nil {
-		log.Printf("Error parsing request: %v", err)
+		// The connection failed before a full request line arrived
+		return true
+	}
+	if !ok {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	s.serveHTTP2(conn, append([]byte(nil), reader.Buffered()...), meta)
+	return true
+}
+
+// serveHTTP2 runs an HTTP/2 connection until it ends
+func (s *Server) serveHTTP2(conn net.Conn, buffered []byte, meta *connMeta) {
+	if err := http2.ServeConn(conn, buffered, s.streamHandler(meta), s.h2Config()); err != nil {
+		log.Printf("HTTP/2 connection error: %v", err)
+	}
+}
+
+// h2Config is the configured HTTP/2 settings tied to this server's shutdown.
+// The body cap from WithMaxBodySize applies unless the config sets its own
+func (s *Server) h2Config() http2.Config {
+	cfg := s.http2Config
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = s.parseOptions.MaxBodySize
+	}
+	cfg.Shutdown = s.shutdown
+	cfg.Context = s.base()
+	return cfg
+}
+
+// handshake completes the TLS handshake up front so ALPN has picked a
+// protocol before the first read
+func (s *Server) handshake(tc *tls.Conn) error {
+	_ = tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+// track records conn and whether it is waiting for its next request, so
+// Shutdown can wake idle connections and close the rest on timeout
+func (s *Server) track(conn net.Conn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = idle
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// serveUpgrade answers an "Upgrade: h2c" request with 101 and carries on in
+// HTTP/2, with the upgrade request served as stream 1
+func (s *Server) serveUpgrade(conn net.Conn, reader *request.Reader, req *request.Request, meta *connMeta) {
+	_ = conn.SetReadDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
 		return
 	}
+	buffered := append([]byte(nil), reader.Buffered()...)
+	settings := req.Headers.Get("HTTP2-Settings")
+	if err := http2.ServeUpgraded(conn, buffered, req, settings, s.streamHandler(meta), s.h2Config()); err != nil {
+		log.Printf("HTTP/2 connection error: %v", err)
+	}
+}
+
+// parseErrorStatus picks the status for a request that failed to parse
+func parseErrorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusContentTooLarge
+	}
+	return response.StatusBadRequest
+}
 
-	writer := response.NewWriter(conn)
-	s.handler(writer, req)
+// methodAllowed checks the configured methods, falling back to the known
+// method registry when none were configured
+func (s *Server) methodAllowed(method request.Method) bool {
+	if s.allowedMethods == nil {
+		return request.IsKnownMethod(method)
+	}
+	_, ok := s.allowedMethods[method]
+	return ok
 }
@@ -0,0 +1,16 @@
+package server
+
+// Middleware wraps a Handler to add behaviour around it
+type Middleware func(Handler) Handler
+
+// Chain wraps h so that the first middleware listed is the outermost, i.e.
+// the first to see each request. Middleware that reports on the response,
+// like access logs and metrics, belongs first so the status and size it
+// sees are what actually went out, after compression and any errors the
+// others wrote
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,12 @@
+package server
+
+// Observer hears about what happens below the handler, where middleware
+// cannot see: connections coming and going and requests that never parsed.
+// Methods are called from many goroutines at once
+type Observer interface {
+	ConnOpened()
+	ConnClosed()
+	// ParseError is called with the error for each HTTP/1 request that
+	// could not be parsed and was answered with an error status
+	ParseError(err error)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/http2"
+	"github.com/isparth/httpfromtcp/internal/proxyproto"
+	"github.com/isparth/httpfromtcp/internal/request"
+)
+
+// Option configures a Server before it starts accepting connections
+type Option func(*Server)
+
+// WithAllowedMethods restricts the methods the server will dispatch to the
+// handler. Anything else is answered with 501 Not Implemented.
+func WithAllowedMethods(methods ...request.Method) Option {
+	return func(s *Server) {
+		s.allowedMethods = make(map[request.Method]struct{}, len(methods))
+		for _, m := range methods {
+			s.allowedMethods[m] = struct{}{}
+		}
+	}
+}
+
+// WithStrictParsing rejects ambiguous message framing instead of resolving it
+func WithStrictParsing() Option {
+	return func(s *Server) {
+		s.parseOptions.Strict = true
+	}
+}
+
+// WithIdleTimeout sets how long a connection may wait for its next request
+// before it is closed. Zero disables the timeout
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithProxyMode lets the parser accept absolute-form and CONNECT
+// authority-form targets so the handler can act as a forward proxy
+func WithProxyMode() Option {
+	return func(s *Server) {
+		s.parseOptions.ProxyMode = true
+	}
+}
+
+// WithMaxBodySize caps request bodies at n bytes. Larger ones get 413 as
+// soon as their size is known, before the body is read
+func WithMaxBodySize(n int) Option {
+	return func(s *Server) {
+		s.parseOptions.MaxBodySize = n
+	}
+}
+
+// WithH2C serves cleartext HTTP/2 alongside HTTP/1.1, both to clients that
+// start with the connection preface and to ones sending "Upgrade: h2c". A
+// zero cfg leaves the config alone, so WithHTTP2Config may come before or
+// after it
+func WithH2C(cfg http2.Config) Option {
+	return func(s *Server) {
+		s.h2c = true
+		if cfg != (http2.Config{}) {
+			s.http2Config = cfg
+		}
+	}
+}
+
+// WithHTTP2Config sets the SETTINGS and limits used for HTTP/2 connections,
+// whether they arrive over TLS or as h2c
+func WithHTTP2Config(cfg http2.Config) Option {
+	return func(s *Server) {
+		s.http2Config = cfg
+	}
+}
+
+// WithTLS serves HTTPS. Unless cfg lists its own NextProtos, ALPN offers h2
+// ahead of http/1.1 so clients that can multiplex will
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		cfg = cfg.Clone()
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
+		// RFC 9113 9.2 requires TLS 1.2 or later for h2
+		if slices.Contains(cfg.NextProtos, http2.NextProtoTLS) && cfg.MinVersion < tls.VersionTLS12 {
+			cfg.MinVersion = tls.VersionTLS12
+		}
+		s.tlsConfig = cfg
+	}
+}
+
+// WithMaxConns caps how many connections are served at once. policy says
+// whether further clients wait to be accepted or are turned away with 503
+func WithMaxConns(n int, policy OverloadPolicy) Option {
+	return func(s *Server) {
+		s.slots = make(chan struct{}, n)
+		s.overload = policy
+	}
+}
+
+// WithMaxConnsPerIP caps how many connections one client address may hold
+// open. Connections over the cap are answered with 503
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = n
+	}
+}
+
+// WithTrustedProxies lists the proxies whose X-Forwarded-For and Forwarded
+// headers are believed when working out Request.ClientIP. Requests from
+// anywhere else get the peer address, whatever headers they carry
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.trusted = prefixes
+	}
+}
+
+// WithProxyProtocol reads a PROXY protocol v1 or v2 header at the start of
+// each connection from a trusted load balancer, so RemoteAddr and LocalAddr
+// are the client's rather than the balancer's
+func WithProxyProtocol(opts proxyproto.Options) Option {
+	return func(s *Server) {
+		s.proxyProtocol = &opts
+	}
+}
+
+// WithObserver reports connections and parse errors to o, for metrics
+func WithObserver(o Observer) Option {
+	return func(s *Server) {
+		s.observer = o
+	}
+}
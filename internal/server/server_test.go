@@ -0,0 +1,510 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/http2"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveConn runs the server's connection loop over an in-memory pipe, sends
+// raw and returns everything the server wrote back
+func serveConn(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	client, conn := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.handle(conn)
+		close(done)
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte(raw))
+	}()
+
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	<-done
+	return string(out)
+}
+
+func echoTarget(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.RequestTarget)
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	s := &Server{handler: echoTarget}
+
+	// Test: Three requests in one write are answered in order
+	out := serveConn(t, s,
+		"GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+			"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody"+
+			"GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+	)
+	assert.Equal(t, 3, strings.Count(out, "HTTP/1.1 200 OK"))
+	one := strings.Index(out, "/one")
+	two := strings.Index(out, "/two")
+	three := strings.Index(out, "/three")
+	require.True(t, one != -1 && two != -1 && three != -1, out)
+	assert.True(t, one < two && two < three, out)
+
+	// Test: A response the handler left unterminated stops the pipeline
+	s = &Server{handler: func(w *response.Writer, req *request.Request) {
+		_ = w.WriteStatusLine(response.StatusOK)
+	}}
+	out = serveConn(t, s,
+		"GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+			"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n",
+	)
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+}
+
+func TestHijack(t *testing.T) {
+	// Test: Handler takes the connection and sees bytes sent after the request
+	s := &Server{handler: func(w *response.Writer, req *request.Request) {
+		conn, pending, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		_, err = w.WriteBody([]byte("too late"))
+		if err == nil {
+			return
+		}
+		// Keep using the connection after the handler returns to prove the
+		// server left it open
+		go func() {
+			defer conn.Close()
+			time.Sleep(10 * time.Millisecond)
+			_, _ = conn.Write(append([]byte("raw:"), pending...))
+		}()
+	}}
+	out := serveConn(t, s, "GET /tunnel HTTP/1.1\r\nHost: localhost\r\n\r\nPING")
+	assert.Equal(t, "raw:PING", out)
+}
+
+// readH2Response reads frames off an HTTP/2 connection until stream 1 ends
+// and returns its :status and body
+func readH2Response(t *testing.T, br *bufio.Reader) (string, string) {
+	t.Helper()
+	dec := http2.NewDecoder(4096)
+	var status, body string
+	for {
+		f, err := http2.ReadFrame(br, 1<<24-1)
+		require.NoError(t, err)
+		if f.StreamID != 1 {
+			continue
+		}
+		switch f.Type {
+		case http2.FrameHeaders:
+			fields, err := dec.Decode(f.Payload)
+			require.NoError(t, err)
+			for _, hf := range fields {
+				if hf.Name == ":status" {
+					status = hf.Value
+				}
+			}
+		case http2.FrameData:
+			body += string(f.Payload)
+		case http2.FrameRSTStream:
+			t.Fatal("stream 1 was reset")
+		}
+		if f.Has(http2.FlagEndStream) {
+			return status, body
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s, err := Serve(0, echoTarget, WithH2C(http2.Config{}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	settings := http2.AppendFrame(nil, http2.Frame{Type: http2.FrameSettings})
+
+	// Test: Prior knowledge, the client opens with the preface
+	conn, br := dial()
+	defer conn.Close()
+	block := http2.Encoder{}.Encode(nil, []http2.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/prior"},
+		{Name: ":authority", Value: "localhost"},
+	})
+	out := append([]byte(http2.ClientPreface), settings...)
+	out = http2.AppendFrame(out, http2.Frame{
+		Type:     http2.FrameHeaders,
+		Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+		StreamID: 1,
+		Payload:  block,
+	})
+	_, err = conn.Write(out)
+	require.NoError(t, err)
+	status, body := readH2Response(t, br)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/prior", body)
+
+	// Test: Upgrade from HTTP/1.1, the request is answered as stream 1
+	conn, br = dial()
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /upgraded HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\n" +
+		"\r\n"))
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	for line != "\r\n" {
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	_, err = conn.Write(append([]byte(http2.ClientPreface), settings...))
+	require.NoError(t, err)
+	status, body = readH2Response(t, br)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/upgraded", body)
+
+	// Test: Plain HTTP/1.1 is unaffected
+	plain := serveConn(t, &Server{handler: echoTarget, h2c: true}, "GET /plain HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(plain, "HTTP/1.1 200 OK\r\n"), plain)
+}
+
+// selfSignedConfig returns a TLS config with a throwaway certificate for
+// 127.0.0.1
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestTLSNegotiation(t *testing.T) {
+	s, err := Serve(0, echoTarget, WithTLS(selfSignedConfig(t)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func(protos ...string) *tls.Conn {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		require.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// Test: ALPN picks h2 and the connection speaks HTTP/2
+	conn := dial("h2", "http/1.1")
+	defer conn.Close()
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	writeH2Get(t, conn, "/secure")
+	status, body := readH2Response(t, bufio.NewReader(conn))
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/secure", body)
+
+	// Test: A client that only offers http/1.1 gets HTTP/1.1
+	conn = dial("http/1.1")
+	defer conn.Close()
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	_, err = conn.Write([]byte("GET /plain HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "/plain"))
+
+	// Test: No ALPN at all falls back to HTTP/1.1
+	conn = dial()
+	defer conn.Close()
+	assert.Empty(t, conn.ConnectionState().NegotiatedProtocol)
+}
+
+// writeH2Get sends the preface, empty SETTINGS and a GET on stream 1
+func writeH2Get(t *testing.T, conn net.Conn, path string) {
+	t.Helper()
+	block := http2.Encoder{}.Encode(nil, []http2.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost"},
+	})
+	out := append([]byte(http2.ClientPreface), http2.AppendFrame(nil, http2.Frame{Type: http2.FrameSettings})...)
+	out = http2.AppendFrame(out, http2.Frame{
+		Type:     http2.FrameHeaders,
+		Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+		StreamID: 1,
+		Payload:  block,
+	})
+	_, err := conn.Write(out)
+	require.NoError(t, err)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			close(started)
+			<-release
+		}
+		echoTarget(w, req)
+	}, WithH2C(http2.Config{}))
+	require.NoError(t, err)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// An idle keep-alive connection and an HTTP/2 one with a request in flight
+	idle := dial()
+	defer idle.Close()
+	_, err = idle.Write([]byte("GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	idleReader := bufio.NewReader(idle)
+	line, err := idleReader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+
+	h2 := dial()
+	defer h2.Close()
+	writeH2Get(t, h2, "/slow")
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Test: HTTP/2 gets GOAWAY naming the stream still being served
+	br := bufio.NewReader(h2)
+	for {
+		f, err := http2.ReadFrame(br, 1<<24-1)
+		require.NoError(t, err)
+		if f.Type == http2.FrameGoAway {
+			assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.Payload))
+			assert.Equal(t, uint32(http2.ErrCodeNo), binary.BigEndian.Uint32(f.Payload[4:]))
+			break
+		}
+	}
+
+	// Test: The idle HTTP/1.1 connection is closed
+	_, err = io.ReadAll(idleReader)
+	require.NoError(t, err)
+
+	// Test: The stream in flight still completes before Shutdown returns
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a stream in flight")
+	default:
+	}
+	close(release)
+	status, body := readH2Response(t, br)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/slow", body)
+	require.NoError(t, <-done)
+}
+
+// waitForCancel is a handler that reports how its context ended
+func waitForCancel(started chan<- struct{}, result chan<- error) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			result <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			result <- nil
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: A client that hangs up cancels the request context
+	started, result := make(chan struct{}), make(chan error, 1)
+	s := &Server{handler: waitForCancel(started, result)}
+	client, conn := net.Pipe()
+	go s.handle(conn)
+	go func() { _, _ = client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")) }()
+	<-started
+	client.Close()
+	require.ErrorIs(t, <-result, context.Canceled)
+
+	// Test: Requests that arrive while a handler runs are still served, and
+	// the context ends once the handler returns
+	var first *request.Request
+	s = &Server{handler: func(w *response.Writer, req *request.Request) {
+		if first == nil {
+			first = req
+			time.Sleep(20 * time.Millisecond)
+			assert.NoError(t, req.Context().Err())
+		}
+		echoTarget(w, req)
+	}}
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	go func() {
+		_, _ = client.Write([]byte("GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		time.Sleep(5 * time.Millisecond)
+		_, _ = client.Write([]byte("GET /two HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	}()
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(out), "HTTP/1.1 200 OK"))
+	assert.Contains(t, string(out), "/two")
+	require.ErrorIs(t, first.Context().Err(), context.Canceled)
+
+	// Test: Shutdown cancels contexts once it runs out of time
+	started, result = make(chan struct{}), make(chan error, 1)
+	srv, err := Serve(0, waitForCancel(started, result))
+	require.NoError(t, err)
+	c, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	require.ErrorIs(t, <-result, context.Canceled)
+}
+
+func TestUnknownMethods(t *testing.T) {
+	s := &Server{handler: echoTarget}
+
+	// Test: Unregistered tokens, lowercase ones included, get 501 rather
+	// than a parse error
+	for _, m := range []string{"BREW", "get", "M-search"} {
+		out := serveConn(t, s, m+" / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented"), out)
+	}
+
+	// Test: The allowlist replaces the registry
+	s = &Server{handler: echoTarget}
+	WithAllowedMethods(request.MethodGet, "M-SEARCH")(s)
+	out := serveConn(t, s, "M-SEARCH / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"), out)
+	out = serveConn(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented"), out)
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	s := &Server{handler: echoTarget}
+
+	// Test: A header section past the buffer limit gets 431
+	out := serveConn(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: "+strings.Repeat("a", 70*1024)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large"), out[:min(len(out), 80)])
+}
+
+func TestHTTP2Options(t *testing.T) {
+	cfg := http2.Config{MaxConcurrentStreams: 8}
+
+	// Test: A zero WithH2C keeps WithHTTP2Config whichever comes first
+	for _, opts := range [][]Option{
+		{WithH2C(http2.Config{}), WithHTTP2Config(cfg)},
+		{WithHTTP2Config(cfg), WithH2C(http2.Config{})},
+	} {
+		s := &Server{}
+		for _, opt := range opts {
+			opt(s)
+		}
+		assert.True(t, s.h2c)
+		assert.Equal(t, cfg, s.http2Config)
+	}
+
+	// Test: A config passed to WithH2C is still used
+	s := &Server{}
+	WithH2C(cfg)(s)
+	assert.Equal(t, cfg, s.http2Config)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	s := &Server{handler: echoTarget}
+	WithMaxBodySize(4)(s)
+
+	// Test: A body over the limit gets 413 and the connection is closed
+	out := serveConn(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large"), out[:min(len(out), 80)])
+
+	// Test: The rest of the body is drained rather than left to make the
+	// kernel reset the connection under the response
+	srv, err := Serve(0, echoTarget, WithMaxBodySize(4))
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	body := strings.Repeat("a", 256*1024)
+	go func() {
+		_, _ = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 413 Content Too Large"), string(resp))
+}
+
+func TestH2CMaxBodySize(t *testing.T) {
+	s, err := Serve(0, echoTarget, WithH2C(http2.Config{}), WithMaxBodySize(4))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	block := http2.Encoder{}.Encode(nil, []http2.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/upload"},
+	})
+	out := append([]byte(http2.ClientPreface), http2.AppendFrame(nil, http2.Frame{Type: http2.FrameSettings})...)
+	out = http2.AppendFrame(out, http2.Frame{Type: http2.FrameHeaders, Flags: http2.FlagEndHeaders, StreamID: 1, Payload: block})
+	out = http2.AppendFrame(out, http2.Frame{Type: http2.FrameData, Flags: http2.FlagEndStream, StreamID: 1, Payload: []byte("hello")})
+	_, err = conn.Write(out)
+	require.NoError(t, err)
+
+	// Test: The server's body cap applies to HTTP/2 streams too
+	status, _ := readH2Response(t, bufio.NewReader(conn))
+	assert.Equal(t, "413", status)
+}
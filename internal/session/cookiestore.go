@@ -0,0 +1,189 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCookieSize is the smallest per-cookie limit browsers agree on
+const maxCookieSize = 4096
+
+// payload is what a cookie store keeps in the cookie
+type payload struct {
+	ID      string            `json:"id"`
+	Expires int64             `json:"exp"`
+	Values  map[string]string `json:"v,omitempty"`
+}
+
+func marshal(s *Session) ([]byte, error) {
+	return json.Marshal(payload{ID: s.ID, Expires: s.Expires.Unix(), Values: s.values})
+}
+
+func unmarshal(b []byte) (*Session, error) {
+	var p payload
+	if err := json.Unmarshal(b, &p); err != nil || p.ID == "" {
+		return nil, ErrInvalid
+	}
+	s := &Session{ID: p.ID, Expires: time.Unix(p.Expires, 0), values: p.Values}
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	if time.Now().After(s.Expires) {
+		return nil, ErrExpired
+	}
+	return s, nil
+}
+
+// SignedStore keeps the session in the cookie in the clear, with an
+// HMAC-SHA256 tag so the client cannot change it. Use EncryptedStore if the
+// client must not read it either
+type SignedStore struct {
+	keys [][]byte
+}
+
+// NewSignedStore signs with the first key and accepts any of them, so keys
+// can be rotated by adding the new one in front and dropping the oldest
+// once its sessions have expired. Keys must be at least 32 bytes
+func NewSignedStore(keys ...[]byte) (*SignedStore, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrKey)
+	}
+	for _, k := range keys {
+		if len(k) < 32 {
+			return nil, fmt.Errorf("%w: signing keys need at least 32 bytes", ErrKey)
+		}
+	}
+	return &SignedStore{keys: keys}, nil
+}
+
+func (st *SignedStore) Load(value string) (*Session, error) {
+	data, tag, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(tag)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	for i, key := range st.keys {
+		if !hmac.Equal(mac, sign(key, data)) {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(data)
+		if err != nil {
+			return nil, ErrInvalid
+		}
+		s, err := unmarshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		// Reissue under the current key
+		s.stale = i > 0
+		return s, nil
+	}
+	return nil, ErrInvalid
+}
+
+func (st *SignedStore) Save(s *Session) (string, error) {
+	raw, err := marshal(s)
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(raw)
+	value := data + "." + base64.RawURLEncoding.EncodeToString(sign(st.keys[0], data))
+	if len(value) > maxCookieSize {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+// Delete does nothing, as the session only exists in the cookie
+func (st *SignedStore) Delete(*Session) error {
+	return nil
+}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// EncryptedStore keeps the session in the cookie sealed with AES-GCM, so
+// the client can neither read nor change it
+type EncryptedStore struct {
+	aeads []cipher.AEAD
+}
+
+// NewEncryptedStore seals with the first key and opens with any of them,
+// rotating the same way as NewSignedStore. Keys must be 16, 24 or 32 bytes
+// for AES-128, AES-192 or AES-256
+func NewEncryptedStore(keys ...[]byte) (*EncryptedStore, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrKey)
+	}
+	st := &EncryptedStore{}
+	for _, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKey, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKey, err)
+		}
+		st.aeads = append(st.aeads, aead)
+	}
+	return st, nil
+}
+
+func (st *EncryptedStore) Load(value string) (*Session, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	for i, aead := range st.aeads {
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrInvalid
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		raw, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			continue
+		}
+		s, err := unmarshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		s.stale = i > 0
+		return s, nil
+	}
+	return nil, ErrInvalid
+}
+
+func (st *EncryptedStore) Save(s *Session) (string, error) {
+	raw, err := marshal(s)
+	if err != nil {
+		return "", err
+	}
+	aead := st.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(raw)+aead.Overhead())
+	rand.Read(nonce)
+	value := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, raw, nil))
+	if len(value) > maxCookieSize {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+// Delete does nothing, as the session only exists in the cookie
+func (st *EncryptedStore) Delete(*Session) error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions on the server and only sends the client their
+// ID. Expired sessions are swept out as the store is used, so it needs no
+// background goroutine. Sessions do not survive a restart
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memoryEntry
+	interval  time.Duration
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty store that sweeps expired sessions at
+// most once per interval. Zero means once a minute
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	if interval == 0 {
+		interval = time.Minute
+	}
+	return &MemoryStore{
+		sessions:  map[string]memoryEntry{},
+		interval:  interval,
+		lastSweep: time.Now(),
+	}
+}
+
+func (st *MemoryStore) Load(id string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+
+	e, ok := st.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if time.Now().After(e.expires) {
+		delete(st.sessions, id)
+		return nil, ErrExpired
+	}
+	return &Session{ID: id, Expires: e.expires, values: maps.Clone(e.values)}, nil
+}
+
+func (st *MemoryStore) Save(s *Session) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+
+	st.sessions[s.ID] = memoryEntry{values: maps.Clone(s.values), expires: s.Expires}
+	return s.ID, nil
+}
+
+func (st *MemoryStore) Delete(s *Session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, s.ID)
+	return nil
+}
+
+// Len returns how many sessions are held, expired or not
+func (st *MemoryStore) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+// sweep drops expired sessions if the interval has passed. The caller holds
+// the lock
+func (st *MemoryStore) sweep() {
+	now := time.Now()
+	if now.Sub(st.lastSweep) < st.interval {
+		return
+	}
+	st.lastSweep = now
+	for id, e := range st.sessions {
+		if now.After(e.expires) {
+			delete(st.sessions, id)
+		}
+	}
+}
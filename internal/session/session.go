@@ -0,0 +1,225 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/cookie"
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+)
+
+var (
+	ErrInvalid        = errors.New("session cookie failed verification")
+	ErrExpired        = errors.New("session has expired")
+	ErrNotFound       = errors.New("session not found")
+	ErrCookieTooLarge = errors.New("session does not fit in a cookie")
+	ErrKey            = errors.New("invalid session key")
+)
+
+// Session is the data kept for one client between requests
+type Session struct {
+	// ID identifies the session. Renew replaces it
+	ID      string
+	Expires time.Time
+
+	values    map[string]string
+	isNew     bool
+	modified  bool
+	renewed   bool
+	destroyed bool
+	// stale is set by a store when the session should be written back even
+	// though the handler did not change it, such as after a key rotation
+	stale bool
+	// oldID is the ID Renew replaced, for the store to drop
+	oldID string
+}
+
+func newSession(ttl time.Duration) *Session {
+	return &Session{
+		ID:      newID(),
+		Expires: time.Now().Add(ttl),
+		values:  map[string]string{},
+		isNew:   true,
+	}
+}
+
+// newID returns 256 random bits, far too many to guess
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *Session) Get(key string) string {
+	return s.values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.values, key)
+	s.modified = true
+}
+
+// Values returns a copy of everything in the session
+func (s *Session) Values() map[string]string {
+	return maps.Clone(s.values)
+}
+
+// IsNew reports whether the session was created for this request
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Renew gives the session a new ID and lifetime while keeping its values.
+// Call it whenever the client's privileges change, on login above all, so
+// an ID planted by an attacker before login is worthless afterwards
+func (s *Session) Renew() {
+	if s.oldID == "" && !s.isNew {
+		s.oldID = s.ID
+	}
+	s.ID = newID()
+	s.renewed = true
+	s.modified = true
+}
+
+// Destroy drops the session and expires its cookie
+func (s *Session) Destroy() {
+	s.values = map[string]string{}
+	s.destroyed = true
+}
+
+// Store keeps sessions, either in the cookie itself or on the server
+type Store interface {
+	// Load returns the session a cookie value refers to. Errors wrap
+	// ErrInvalid, ErrExpired or ErrNotFound
+	Load(value string) (*Session, error)
+	// Save stores s and returns the cookie value that refers to it
+	Save(s *Session) (string, error)
+	// Delete removes s from the store
+	Delete(s *Session) error
+}
+
+type Options struct {
+	Store Store
+	// CookieName defaults to "session"
+	CookieName string
+	// Path defaults to "/"
+	Path   string
+	Domain string
+	Secure bool
+	// SameSite defaults to Lax
+	SameSite cookie.SameSite
+	// MaxAge is how long a session lasts from creation or renewal. Default
+	// 24 hours
+	MaxAge time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.CookieName == "" {
+		o.CookieName = "session"
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.SameSite == cookie.SameSiteDefault {
+		o.SameSite = cookie.SameSiteLax
+	}
+	if o.MaxAge == 0 {
+		o.MaxAge = 24 * time.Hour
+	}
+	return o
+}
+
+type sessionKey struct{}
+
+// From returns the session the middleware loaded for req, or nil when the
+// middleware is not in the chain
+func From(req *request.Request) *Session {
+	s, _ := req.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// New returns middleware that loads the session before the handler runs and
+// saves it as the response headers go out, so changes made after the
+// handler has started writing are lost. A missing, forged or expired
+// cookie just starts a new session. New sessions are only sent to the
+// client once something is stored in them
+func New(opts Options) server.Middleware {
+	opts = opts.withDefaults()
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			var sess *Session
+			if c, err := cookie.Get(req, opts.CookieName); err == nil {
+				sess, _ = opts.Store.Load(c.Value)
+			}
+			if sess == nil {
+				sess = newSession(opts.MaxAge)
+			}
+			req.SetValue(sessionKey{}, sess)
+			w.OnHeaders(func(_ response.StatusCode, h response.Headers) {
+				if err := commit(opts, sess, h); err != nil {
+					log.Printf("Session error: %v", err)
+				}
+			})
+			next(w, req)
+		}
+	}
+}
+
+// commit saves sess and adds the Set-Cookie line that goes with it
+func commit(opts Options, sess *Session, h response.Headers) error {
+	if sess.oldID != "" {
+		old := *sess
+		old.ID = sess.oldID
+		if err := opts.Store.Delete(&old); err != nil {
+			return err
+		}
+		sess.oldID = ""
+	}
+
+	if sess.destroyed {
+		if sess.isNew {
+			return nil
+		}
+		if err := opts.Store.Delete(sess); err != nil {
+			return err
+		}
+		return cookie.Delete(h, opts.CookieName, opts.Path, opts.Domain)
+	}
+
+	if sess.isNew && len(sess.values) == 0 {
+		return nil
+	}
+	if !sess.modified && !sess.stale {
+		return nil
+	}
+	if sess.renewed {
+		sess.Expires = time.Now().Add(opts.MaxAge)
+	}
+
+	value, err := opts.Store.Save(sess)
+	if err != nil {
+		return err
+	}
+	return cookie.Set(h, cookie.Cookie{
+		Name:     opts.CookieName,
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		Expires:  sess.Expires,
+		MaxAge:   max(int(time.Until(sess.Expires).Seconds()), 1),
+		Secure:   opts.Secure,
+		HttpOnly: true,
+		SameSite: opts.SameSite,
+	})
+}
@@ -0,0 +1,194 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/isparth/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// app logs in on /login, logs out on /logout and reports the user otherwise
+func app(w *response.Writer, req *request.Request) {
+	sess := From(req)
+	switch req.RequestLine.RequestTarget {
+	case "/login":
+		sess.Renew()
+		sess.Set("user", "ada")
+	case "/logout":
+		sess.Destroy()
+	}
+	body := []byte(sess.Get("user"))
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+// do sends a request with the given session cookie and returns the body and
+// any session cookie set in reply
+func do(t *testing.T, h server.Handler, target, value string) (string, *http.Cookie) {
+	t.Helper()
+	raw := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	if value != "" {
+		raw += "Cookie: theme=dark; session=" + value + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	h(response.NewWriter(&out), req)
+	resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	for _, c := range resp.Cookies() {
+		if c.Name == "session" {
+			return body.String(), c
+		}
+	}
+	return body.String(), nil
+}
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestStores(t *testing.T) {
+	signed, err := NewSignedStore(key(1))
+	require.NoError(t, err)
+	encrypted, err := NewEncryptedStore(key(1))
+	require.NoError(t, err)
+	stores := map[string]Store{"signed": signed, "encrypted": encrypted, "memory": NewMemoryStore(0)}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			h := New(Options{Store: store})(app)
+
+			// Test: Empty sessions are not sent
+			body, c := do(t, h, "/", "")
+			assert.Empty(t, body)
+			assert.Nil(t, c)
+
+			// Test: Login issues a cookie that carries the session
+			_, c = do(t, h, "/login", "")
+			require.NotNil(t, c)
+			assert.True(t, c.HttpOnly)
+			assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+			assert.Equal(t, "/", c.Path)
+			assert.Greater(t, c.MaxAge, 0)
+			body, c2 := do(t, h, "/", c.Value)
+			assert.Equal(t, "ada", body)
+			assert.Nil(t, c2, "unchanged sessions are not resent")
+
+			// Test: Tampered and unknown cookies start a fresh session
+			tampered := []byte(c.Value)
+			tampered[len(tampered)/2] ^= 1
+			body, _ = do(t, h, "/", string(tampered))
+			assert.Empty(t, body)
+			body, _ = do(t, h, "/", "garbage")
+			assert.Empty(t, body)
+
+			// Test: Logout expires the cookie
+			_, c3 := do(t, h, "/logout", c.Value)
+			require.NotNil(t, c3)
+			assert.Equal(t, -1, c3.MaxAge)
+		})
+	}
+}
+
+func TestFixation(t *testing.T) {
+	store := NewMemoryStore(0)
+	h := New(Options{Store: store})(app)
+
+	// Test: An ID the store never issued is not adopted
+	_, c := do(t, h, "/login", "attacker-chosen-id")
+	require.NotNil(t, c)
+	assert.NotEqual(t, "attacker-chosen-id", c.Value)
+
+	// Test: Logging in again replaces the ID and drops the old session
+	_, c2 := do(t, h, "/login", c.Value)
+	require.NotNil(t, c2)
+	assert.NotEqual(t, c.Value, c2.Value)
+	body, _ := do(t, h, "/", c.Value)
+	assert.Empty(t, body)
+	body, _ = do(t, h, "/", c2.Value)
+	assert.Equal(t, "ada", body)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestKeyRotation(t *testing.T) {
+	for name, newStore := range map[string]func(...[]byte) (Store, error){
+		"signed":    func(k ...[]byte) (Store, error) { return NewSignedStore(k...) },
+		"encrypted": func(k ...[]byte) (Store, error) { return NewEncryptedStore(k...) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			old, err := newStore(key(1))
+			require.NoError(t, err)
+			_, c := do(t, New(Options{Store: old})(app), "/login", "")
+			require.NotNil(t, c)
+
+			// Test: Cookies under the old key still load and are reissued
+			rotated, err := newStore(key(2), key(1))
+			require.NoError(t, err)
+			h := New(Options{Store: rotated})(app)
+			body, c2 := do(t, h, "/", c.Value)
+			assert.Equal(t, "ada", body)
+			require.NotNil(t, c2)
+			assert.NotEqual(t, c.Value, c2.Value)
+
+			// Test: Once the old key is dropped only the reissued cookie works
+			current, err := newStore(key(2))
+			require.NoError(t, err)
+			h = New(Options{Store: current})(app)
+			body, _ = do(t, h, "/", c.Value)
+			assert.Empty(t, body)
+			body, _ = do(t, h, "/", c2.Value)
+			assert.Equal(t, "ada", body)
+		})
+	}
+
+	// Test: Bad keys
+	_, err := NewSignedStore([]byte("short"))
+	require.ErrorIs(t, err, ErrKey)
+	_, err = NewEncryptedStore(make([]byte, 20))
+	require.ErrorIs(t, err, ErrKey)
+	_, err = NewEncryptedStore()
+	require.ErrorIs(t, err, ErrKey)
+}
+
+func TestExpiry(t *testing.T) {
+	// Test: Cookie stores reject sessions past their expiry
+	signed, err := NewSignedStore(key(1))
+	require.NoError(t, err)
+	s := newSession(-time.Minute)
+	value, err := signed.Save(s)
+	require.NoError(t, err)
+	_, err = signed.Load(value)
+	require.ErrorIs(t, err, ErrExpired)
+
+	// Test: The memory store evicts expired sessions on its next sweep
+	mem := NewMemoryStore(time.Millisecond)
+	_, err = mem.Save(newSession(-time.Minute))
+	require.NoError(t, err)
+	live := newSession(time.Hour)
+	_, err = mem.Save(live)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+	_, err = mem.Load(live.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, mem.Len())
+
+	// Test: Oversized cookie sessions fail to save
+	big := newSession(time.Hour)
+	big.Set("blob", strings.Repeat("x", maxCookieSize))
+	_, err = signed.Save(big)
+	require.ErrorIs(t, err, ErrCookieTooLarge)
+}
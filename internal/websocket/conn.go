@@ -0,0 +1,406 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType identifies the kind of data message
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// CloseCode is a status code carried by a close frame (RFC 6455 7.4)
+type CloseCode uint16
+
+const (
+	CloseNormal          CloseCode = 1000
+	CloseGoingAway       CloseCode = 1001
+	CloseProtocolError   CloseCode = 1002
+	CloseUnsupportedData CloseCode = 1003
+	CloseNoStatus        CloseCode = 1005
+	CloseInvalidPayload  CloseCode = 1007
+	ClosePolicyViolation CloseCode = 1008
+	CloseMessageTooBig   CloseCode = 1009
+	CloseInternalError   CloseCode = 1011
+	CloseServiceRestart  CloseCode = 1012
+	CloseTryAgainLater   CloseCode = 1013
+	CloseBadGateway      CloseCode = 1014
+)
+
+const (
+	defaultReadLimit = 1 << 20
+	// closeTimeout bounds how long Close waits for the peer's close frame
+	closeTimeout = 5 * time.Second
+)
+
+// deflateTail is stripped from compressed messages and restored before
+// inflating them (RFC 7692 7.2.1)
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// CloseError is returned by ReadMessage once the peer has closed
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a websocket connection on top of an already upgraded stream
+type Conn struct {
+	rw        io.ReadWriter
+	br        *bufio.Reader
+	isServer  bool
+	compress  bool
+	readLimit int
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	// reading holds a token while a goroutine reads frames, so Close can
+	// leave the peer's close frame to a ReadMessage already waiting for it
+	reading chan struct{}
+	// readDone is closed once no more frames will arrive: the peer's close
+	// frame was read or the stream failed
+	readDone     chan struct{}
+	readDoneOnce sync.Once
+
+	// PongHandler, when set, is called with the payload of every pong
+	PongHandler func(data []byte)
+}
+
+// NewServerConn wraps the connection of a completed server handshake
+func NewServerConn(rw io.ReadWriter, hs Handshake, opts Options) *Conn {
+	return newConn(rw, true, hs.Compression, opts.ReadLimit)
+}
+
+// NewClientConn wraps the client end of a connection, masking every frame
+func NewClientConn(rw io.ReadWriter, hs Handshake, opts Options) *Conn {
+	return newConn(rw, false, hs.Compression, opts.ReadLimit)
+}
+
+func newConn(rw io.ReadWriter, isServer, compress bool, readLimit int) *Conn {
+	if readLimit <= 0 {
+		readLimit = defaultReadLimit
+	}
+	return &Conn{
+		rw:        rw,
+		br:        bufio.NewReader(rw),
+		isServer:  isServer,
+		compress:  compress,
+		readLimit: readLimit,
+		reading:   make(chan struct{}, 1),
+		readDone:  make(chan struct{}),
+	}
+}
+
+// ReadMessage returns the next complete data message. Fragments are
+// reassembled, pings are answered and pongs are handed to PongHandler
+// along the way. After the peer closes it returns a *CloseError. It may
+// run alongside the write methods and Close, but not another ReadMessage
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.reading <- struct{}{}
+	defer func() { <-c.reading }()
+	if c.readEnded() {
+		return 0, nil, ErrConnectionDone
+	}
+
+	var (
+		msgType    MessageType
+		compressed bool
+		started    bool
+		data       []byte
+	)
+
+	for {
+		f, err := readFrame(c.br, c.isServer, c.readLimit)
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeControl(opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case opPong:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(fmt.Errorf("%w: continuation without a message", ErrProtocolError))
+			}
+			if f.rsv1 {
+				return 0, nil, c.fail(fmt.Errorf("%w: RSV1 on a continuation frame", ErrProtocolError))
+			}
+
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(fmt.Errorf("%w: new message inside a fragmented one", ErrProtocolError))
+			}
+			if f.rsv1 && !c.compress {
+				return 0, nil, c.fail(fmt.Errorf("%w: RSV1 without compression", ErrProtocolError))
+			}
+			started = true
+			msgType = MessageType(f.opcode)
+			compressed = f.rsv1
+		}
+
+		if len(data)+len(f.payload) > c.readLimit {
+			return 0, nil, c.fail(ErrMessageTooBig)
+		}
+		data = append(data, f.payload...)
+
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			if data, err = c.inflate(data); err != nil {
+				return 0, nil, c.fail(err)
+			}
+		}
+		if msgType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, c.fail(ErrInvalidUTF8)
+		}
+		return msgType, data, nil
+	}
+}
+
+// WriteMessage sends data as a single frame, compressing it when
+// permessage-deflate was negotiated
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	f := frame{fin: true, opcode: opcode(t), payload: data}
+	if c.compress && len(data) > 0 {
+		compressed, err := deflate(data)
+		if err != nil {
+			return err
+		}
+		f.rsv1 = true
+		f.payload = compressed
+	}
+	return c.writeFrames(f)
+}
+
+// WriteFragments sends one message split across a frame per part
+func (c *Conn) WriteFragments(t MessageType, parts ...[]byte) error {
+	if len(parts) == 0 {
+		return c.WriteMessage(t, nil)
+	}
+	frames := make([]frame, len(parts))
+	for i, p := range parts {
+		frames[i] = frame{fin: i == len(parts)-1, opcode: opContinuation, payload: p}
+	}
+	frames[0].opcode = opcode(t)
+	return c.writeFrames(frames...)
+}
+
+// Ping sends a ping. The matching pong arrives through PongHandler
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+// Close runs the closing handshake: it sends a close frame, waits briefly
+// for the peer's reply and then closes the underlying stream. If another
+// goroutine is in ReadMessage, that call reads the reply and returns the
+// *CloseError; otherwise Close reads and discards frames until it arrives
+func (c *Conn) Close(code CloseCode, reason string) error {
+	if err := c.sendClose(code, reason); err != nil && !errors.Is(err, ErrConnectionDone) {
+		return err
+	}
+
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+	select {
+	case c.reading <- struct{}{}:
+		if !c.readEnded() {
+			if d, ok := c.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+				_ = d.SetReadDeadline(time.Now().Add(closeTimeout))
+			}
+			for {
+				f, err := readFrame(c.br, c.isServer, c.readLimit)
+				if err != nil || f.opcode == opClose {
+					break
+				}
+			}
+			c.endRead()
+		}
+		<-c.reading
+	case <-c.readDone:
+	case <-timer.C:
+		// Closing the stream below unblocks the reader
+	}
+
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *Conn) endRead() {
+	c.readDoneOnce.Do(func() { close(c.readDone) })
+}
+
+func (c *Conn) readEnded() bool {
+	select {
+	case <-c.readDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleClose answers a close frame from the peer by echoing its code
+func (c *Conn) handleClose(payload []byte) error {
+	c.endRead()
+
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(fmt.Errorf("%w: truncated close code", ErrProtocolError))
+	case len(payload) >= 2:
+		closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(fmt.Errorf("%w: invalid close code %d", ErrProtocolError, closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(ErrInvalidUTF8)
+		}
+	}
+
+	echo := closeErr.Code
+	if echo == CloseNoStatus {
+		echo = CloseNormal
+	}
+	if err := c.sendClose(echo, ""); err != nil && !errors.Is(err, ErrConnectionDone) {
+		return err
+	}
+	return closeErr
+}
+
+// fail sends the close frame matching err and returns err
+func (c *Conn) fail(err error) error {
+	code := CloseProtocolError
+	switch {
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	case !errors.Is(err, ErrProtocolError):
+		// I/O errors mean the stream is gone, there is nobody to tell
+		c.endRead()
+		return err
+	}
+	_ = c.sendClose(code, "")
+	return err
+}
+
+func (c *Conn) sendClose(code CloseCode, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload = append(payload, reason...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrConnectionDone
+	}
+	c.closeSent = true
+	return c.writeLocked(frame{fin: true, opcode: opClose, payload: payload})
+}
+
+func (c *Conn) writeControl(op opcode, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("%w: control payload too large", ErrProtocolError)
+	}
+	return c.writeFrames(frame{fin: true, opcode: op, payload: payload})
+}
+
+func (c *Conn) writeFrames(frames ...frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrConnectionDone
+	}
+	return c.writeLocked(frames...)
+}
+
+func (c *Conn) writeLocked(frames ...frame) error {
+	var buf []byte
+	for _, f := range frames {
+		var err error
+		if buf, err = appendFrame(buf, f, !c.isServer); err != nil {
+			return err
+		}
+	}
+	_, err := c.rw.Write(buf)
+	return err
+}
+
+func (c *Conn) inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)))
+	defer r.Close()
+
+	// Read one byte past the limit so a decompression bomb is caught
+	// without inflating all of it
+	out, err := io.ReadAll(io.LimitReader(r, int64(c.readLimit)+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: bad deflate data", ErrProtocolError)
+	}
+	if len(out) > c.readLimit {
+		return nil, ErrMessageTooBig
+	}
+	return out, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// validCloseCode accepts the codes a peer may send: the registered ones
+// (RFC 6455 7.4.1 and the IANA registry) plus the ranges for libraries
+// and applications
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xA
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+
+	// maxControlPayload is the largest payload a control frame may carry
+	maxControlPayload = 125
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  opcode
+	payload []byte
+}
+
+// readFrame reads one frame, enforcing the masking direction and the size
+// limit before the payload is allocated
+func readFrame(r io.Reader, expectMasked bool, limit int) (frame, error) {
+	var f frame
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return f, err
+	}
+
+	f.fin = head[0]&finBit != 0
+	f.rsv1 = head[0]&rsv1Bit != 0
+	f.opcode = opcode(head[0] & 0x0F)
+	masked := head[1]&maskBit != 0
+
+	if head[0]&(rsv2Bit|rsv3Bit) != 0 {
+		return f, fmt.Errorf("%w: reserved bits set", ErrProtocolError)
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return f, fmt.Errorf("%w: unknown opcode 0x%x", ErrProtocolError, byte(f.opcode))
+	}
+	if masked != expectMasked {
+		return f, fmt.Errorf("%w: unexpected mask bit", ErrProtocolError)
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, fmt.Errorf("%w: invalid payload length", ErrProtocolError)
+		}
+	}
+
+	if f.opcode.isControl() {
+		if !f.fin || length > maxControlPayload || f.rsv1 {
+			return f, fmt.Errorf("%w: invalid control frame", ErrProtocolError)
+		}
+	}
+	if length > uint64(limit) {
+		return f, ErrMessageTooBig
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return f, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// appendFrame encodes a frame onto buf. Clients must mask every frame
+// they send, servers never do
+func appendFrame(buf []byte, f frame, mask bool) ([]byte, error) {
+	b0 := byte(f.opcode)
+	if f.fin {
+		b0 |= finBit
+	}
+	if f.rsv1 {
+		b0 |= rsv1Bit
+	}
+	buf = append(buf, b0)
+
+	var b1 byte
+	if mask {
+		b1 = maskBit
+	}
+	n := len(f.payload)
+	switch {
+	case n <= 125:
+		buf = append(buf, b1|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if !mask {
+		return append(buf, f.payload...), nil
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, f.payload...)
+	maskBytes(key, buf[start:])
+	return buf, nil
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
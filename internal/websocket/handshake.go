@@ -0,0 +1,176 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+)
+
+var (
+	ErrNotUpgrade     = errors.New("request is not a websocket upgrade")
+	ErrBadVersion     = errors.New("unsupported Sec-WebSocket-Version")
+	ErrBadKey         = errors.New("missing or malformed Sec-WebSocket-Key")
+	ErrBadHandshake   = errors.New("websocket handshake failed")
+	ErrProtocolError  = errors.New("websocket protocol error")
+	ErrMessageTooBig  = errors.New("websocket message exceeds read limit")
+	ErrInvalidUTF8    = errors.New("websocket text is not valid UTF-8")
+	ErrConnectionDone = errors.New("websocket connection already closed")
+)
+
+// acceptGUID is the fixed suffix from RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Options configures the server side of the handshake
+type Options struct {
+	// Subprotocols the server supports, in order of preference
+	Subprotocols []string
+	// EnableCompression negotiates permessage-deflate when the client offers it
+	EnableCompression bool
+	// ReadLimit caps the size of a reassembled message. Zero means 1MiB
+	ReadLimit int
+}
+
+// Handshake is the outcome of a successful negotiation
+type Handshake struct {
+	Subprotocol string
+	Compression bool
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a client's Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether req asks to switch to the websocket protocol
+func IsUpgrade(req *request.Request) bool {
+	return req.RequestLine.Method == request.MethodGet &&
+		req.Headers.HasToken("Connection", "upgrade") &&
+		req.Headers.HasToken("Upgrade", "websocket")
+}
+
+// WriteHandshake validates the upgrade request and answers it with
+// 101 Switching Protocols. On error nothing has been written, so the caller
+// can still send a regular error response
+func WriteHandshake(w *response.Writer, req *request.Request, opts Options) (Handshake, error) {
+	var hs Handshake
+
+	if !IsUpgrade(req) {
+		return hs, ErrNotUpgrade
+	}
+	if req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		return hs, ErrBadVersion
+	}
+	key := req.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return hs, ErrBadKey
+	}
+
+	hs.Subprotocol = negotiateSubprotocol(req.Headers.Get("Sec-WebSocket-Protocol"), opts.Subprotocols)
+	hs.Compression = opts.EnableCompression && offersDeflate(req.Headers.Get("Sec-WebSocket-Extensions"))
+
+	h := response.Headers{}
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	if hs.Subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", hs.Subprotocol)
+	}
+	if hs.Compression {
+		// Without context takeover every message is compressed on its own,
+		// which keeps per-connection memory flat
+		h.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return hs, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return hs, err
+	}
+	return hs, nil
+}
+
+// Upgrade completes the handshake and takes over the connection from the
+// server. On a handshake error nothing has been written and the handler
+// still owns the response
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	hs, err := WriteHandshake(w, req, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, pending, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames the client sent straight after its handshake may already be
+	// sitting in the parser's buffer
+	rw := &hijackedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(pending), conn)}
+	return NewServerConn(rw, hs, opts), nil
+}
+
+// hijackedConn replays bytes the request parser had buffered before
+// reading from the connection itself
+type hijackedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// negotiateSubprotocol picks the server's most preferred protocol that the
+// client also offered
+func negotiateSubprotocol(offered string, supported []string) string {
+	if offered == "" {
+		return ""
+	}
+	for _, want := range supported {
+		for _, p := range strings.Split(offered, ",") {
+			if strings.TrimSpace(p) == want {
+				return want
+			}
+		}
+	}
+	return ""
+}
+
+// offersDeflate looks for a permessage-deflate offer we can accept. Offers
+// that fix a window size below the default are skipped since the flate
+// package always uses a 32KiB window
+func offersDeflate(extensions string) bool {
+	for _, ext := range strings.Split(extensions, ",") {
+		params := strings.Split(ext, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover":
+			case "client_max_window_bits":
+				// A bare client_max_window_bits only says the client can
+				// honour a limit; we never set one
+			case "server_max_window_bits":
+				ok = ok && strings.Trim(value, `"`) == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isparth/httpfromtcp/internal/request"
+	"github.com/isparth/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWriteHandshake(t *testing.T) {
+	raw := "GET /live HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: chat, dashboard.v2\r\n" +
+		"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n" +
+		"\r\n"
+
+	// Test: Valid upgrade negotiates subprotocol and compression
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	hs, err := WriteHandshake(response.NewWriter(&out), req, Options{
+		Subprotocols:      []string{"dashboard.v2", "chat"},
+		EnableCompression: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "dashboard.v2", hs.Subprotocol)
+	assert.True(t, hs.Compression)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, out.String(), "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+
+	// Test: Wrong version is refused before anything is written
+	req, err = request.RequestFromReader(strings.NewReader(strings.Replace(raw, "Version: 13", "Version: 8", 1)))
+	require.NoError(t, err)
+	out.Reset()
+	_, err = WriteHandshake(response.NewWriter(&out), req, Options{})
+	require.ErrorIs(t, err, ErrBadVersion)
+	assert.Empty(t, out.String())
+
+	// Test: Plain GET is not an upgrade
+	req, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = WriteHandshake(response.NewWriter(&out), req, Options{})
+	require.ErrorIs(t, err, ErrNotUpgrade)
+}
+
+// pipeConns connects a server and client Conn over loopback TCP so writes
+// are buffered by the kernel and do not need a reader waiting on them
+func pipeConns(t *testing.T, compress bool, opts Options) (*Conn, *Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	b, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	a, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	hs := Handshake{Compression: compress}
+	return NewServerConn(a, hs, opts), NewClientConn(b, hs, Options{})
+}
+
+func TestMessages(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		server, client := pipeConns(t, compress, Options{})
+
+		// Test: Single frame, fragmented and large messages round trip
+		large := bytes.Repeat([]byte("live update "), 10000)
+		require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+		require.NoError(t, client.WriteFragments(BinaryMessage, []byte("frag"), []byte("men"), []byte("ted")))
+		go func() { _ = client.WriteMessage(BinaryMessage, large) }()
+
+		mt, data, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, TextMessage, mt)
+		assert.Equal(t, "hello", string(data))
+
+		mt, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, BinaryMessage, mt)
+		assert.Equal(t, "fragmented", string(data))
+
+		_, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, large, data)
+
+		// Test: Ping is answered with a pong carrying the same payload
+		var pong string
+		client.PongHandler = func(p []byte) { pong = string(p) }
+		require.NoError(t, client.Ping([]byte("are you there")))
+		require.NoError(t, client.WriteMessage(TextMessage, []byte("after ping")))
+
+		_, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "after ping", string(data))
+
+		// Test: Server to client
+		require.NoError(t, server.WriteMessage(TextMessage, []byte("pushed")))
+		_, data, err = client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "pushed", string(data))
+		assert.Equal(t, "are you there", pong)
+
+		// Test: Close handshake
+		closed := make(chan error, 1)
+		go func() {
+			_, _, err := server.ReadMessage()
+			closed <- err
+		}()
+		require.NoError(t, client.Close(CloseNormal, "bye"))
+		var closeErr *CloseError
+		require.ErrorAs(t, <-closed, &closeErr)
+		assert.Equal(t, CloseNormal, closeErr.Code)
+	}
+}
+
+func TestCloseAndProtocolErrors(t *testing.T) {
+	// Test: Peer close surfaces as CloseError with its code
+	server, client := pipeConns(t, false, Options{})
+	go func() { _ = client.Close(CloseGoingAway, "shutting down") }()
+	_, _, err := server.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "shutting down", closeErr.Reason)
+	_, _, err = server.ReadMessage()
+	require.ErrorIs(t, err, ErrConnectionDone)
+
+	// Test: Codes registered after RFC 6455 are accepted too
+	server, client = pipeConns(t, false, Options{})
+	go func() { _ = client.Close(CloseTryAgainLater, "") }()
+	_, _, err = server.ReadMessage()
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseTryAgainLater, closeErr.Code)
+	for _, code := range []CloseCode{CloseServiceRestart, CloseBadGateway, 3000, 4999} {
+		assert.True(t, validCloseCode(code), code)
+	}
+	for _, code := range []CloseCode{999, 1004, CloseNoStatus, 1006, 1015, 2999, 5000} {
+		assert.False(t, validCloseCode(code), code)
+	}
+
+	// Test: Unmasked client frame is a protocol error
+	server, client = pipeConns(t, false, Options{})
+	frameBytes, err := appendFrame(nil, frame{fin: true, opcode: opText, payload: []byte("hi")}, false)
+	require.NoError(t, err)
+	_, err = client.rw.Write(frameBytes)
+	require.NoError(t, err)
+	_, _, err = server.ReadMessage()
+	require.ErrorIs(t, err, ErrProtocolError)
+
+	// Test: Message over the read limit
+	server, client = pipeConns(t, false, Options{ReadLimit: 8})
+	require.NoError(t, client.WriteMessage(BinaryMessage, []byte("way too long")))
+	_, _, err = server.ReadMessage()
+	require.ErrorIs(t, err, ErrMessageTooBig)
+
+	// Test: Invalid UTF-8 in a text message
+	server, client = pipeConns(t, false, Options{})
+	require.NoError(t, client.WriteMessage(TextMessage, []byte{0xff, 0xfe}))
+	_, _, err = server.ReadMessage()
+	require.ErrorIs(t, err, ErrInvalidUTF8)
+
+	// Test: Compressed bomb is capped by the read limit
+	server, client = pipeConns(t, true, Options{ReadLimit: 1024})
+	require.NoError(t, client.WriteMessage(BinaryMessage, make([]byte, 1<<20)))
+	_, _, err = server.ReadMessage()
+	require.ErrorIs(t, err, ErrMessageTooBig)
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	server, client := pipeConns(t, false, Options{})
+
+	// The client reads until the close arrives, which echoes it
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Test: Close from another goroutine leaves the reply to the waiting
+	// ReadMessage instead of racing it for the stream
+	start := time.Now()
+	require.NoError(t, server.Close(CloseGoingAway, ""))
+	assert.Less(t, time.Since(start), closeTimeout)
+	var closeErr *CloseError
+	require.ErrorAs(t, <-read, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+
+	_, _, err := server.ReadMessage()
+	require.ErrorIs(t, err, ErrConnectionDone)
+}